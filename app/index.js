@@ -3,9 +3,16 @@
 const errorAlert = document.getElementById("error-alert");
 const encryptForm = document.querySelector("#encrypt-tab form");
 const decryptForm = document.querySelector("#decrypt-tab form");
+const manageForm = document.querySelector("#manage-tab form");
 const encryptResultDiv = document.getElementById("encrypt-result");
+const peekResultDiv = document.getElementById("peek-result");
 const decryptResultDiv = document.getElementById("decrypt-result");
+const manageResultDiv = document.getElementById("manage-result");
 const decryptKey = document.getElementById("decrypt-key");
+const manageToken = document.getElementById("manage-token");
+const revokeButton = document.getElementById("revoke-btn");
+const revealButton = document.getElementById("reveal-btn");
+const manageHashPrefix = "#manage=";
 
 function createDecryptLink(pwd, key) {
   return `${window.location.origin}${window.location.pathname}#${pwd}x${key}`;
@@ -16,15 +23,28 @@ function parseDecryptKey() {
   return { pwd, key };
 }
 
+function createManageLink(token) {
+  return `${window.location.origin}${window.location.pathname}${manageHashPrefix}${token}`;
+}
+
 function setDecryptKeyFromLocation() {
   const hash = window.location.hash;
-  if (!!hash) {
+  if (!!hash && !hash.startsWith(manageHashPrefix)) {
     decryptKey.value = hash.substring(1);
     return true;
   }
   return false;
 }
 
+function setManageTokenFromLocation() {
+  const hash = window.location.hash;
+  if (hash.startsWith(manageHashPrefix)) {
+    manageToken.value = hash.substring(manageHashPrefix.length);
+    return true;
+  }
+  return false;
+}
+
 function encodeBase64(bytes) {
   const numbers = new Uint8Array(bytes);
   return btoa(String.fromCharCode(...numbers));
@@ -84,15 +104,22 @@ function handleFetchResponse(res) {
   throw new Error(`${res.status}: ${res.statusText}`);
 }
 
-function setSecret(secret, ttl) {
+function setSecret(secret, ttl, notify) {
   const body = new URLSearchParams();
   body.set("secret", secret);
   body.set("ttl", ttl);
+  if (!!notify) {
+    body.set("notify", notify);
+  }
   const opts = {
     method: "POST",
     body: body,
   };
-  return fetch("/push", opts).then(handleFetchResponse);
+  return fetch("/push", opts).then((res) => {
+    return handleFetchResponse(res).then((key) => {
+      return { key: key, token: res.headers.get("X-Manage-Token") };
+    });
+  });
 }
 
 function getSecret(secretKey) {
@@ -105,6 +132,30 @@ function getSecret(secretKey) {
   return fetch("/pull", opts).then(handleFetchResponse);
 }
 
+function peekSecret(secretKey) {
+  const body = new URLSearchParams();
+  body.set("key", secretKey);
+  const opts = {
+    method: "POST",
+    body: body,
+  };
+  return fetch("/peek", opts)
+    .then(handleFetchResponse)
+    .then((txt) => JSON.parse(txt));
+}
+
+function manageSecret(action, token) {
+  const body = new URLSearchParams();
+  body.set("token", token);
+  const opts = {
+    method: "POST",
+    body: body,
+  };
+  return fetch(`/${action}`, opts)
+    .then(handleFetchResponse)
+    .then((txt) => JSON.parse(txt));
+}
+
 function showElement(element) {
   element.style.display = "";
 }
@@ -126,28 +177,94 @@ function updateErrorAlert(message) {
   showElement(errorAlert);
 }
 
-function updateEncryptResults(pwd, key, ttl) {
-  const link = createDecryptLink(pwd, key);
+function updateEncryptResults(pwd, created, ttl) {
+  const link = createDecryptLink(pwd, created.key);
   const ttlTxt = ttl === "1" ? "1 hour" : `${ttl} hours`;
   const expiry = Date.now() + parseInt(ttl) * 60 * 60 * 1000;
   const expiryTxt = new Date(expiry).toLocaleString();
 
   encryptResultDiv.querySelector(".copy-me").textContent = link;
+  encryptResultDiv.querySelector(".manage-link").textContent = createManageLink(created.token);
   encryptResultDiv.querySelector(".expire-in").textContent = ttlTxt;
   encryptResultDiv.querySelector(".expire-at").textContent = expiryTxt;
   showElement(encryptResultDiv);
 }
 
+function updatePeekResults(peek) {
+  let stateTxt;
+  if (peek.exists && !!peek.not_before && new Date(peek.not_before) > Date.now()) {
+    const expiryTxt = new Date(peek.expire_at).toLocaleString();
+    const unlockTxt = new Date(peek.not_before).toLocaleString();
+    stateTxt = `cannot be recovered until ${unlockTxt}, and will expire on ${expiryTxt} if not used.`;
+    hideElement(revealButton.parentElement);
+  } else if (peek.exists) {
+    const expiryTxt = new Date(peek.expire_at).toLocaleString();
+    stateTxt = `is waiting to be recovered, and will expire on ${expiryTxt} if not used.`;
+    showElement(revealButton.parentElement);
+  } else {
+    stateTxt = "cannot be found. It may have expired, or have already been recovered.";
+    hideElement(revealButton.parentElement);
+  }
+  peekResultDiv.querySelector(".peek-state").textContent = stateTxt;
+  showElement(peekResultDiv);
+}
+
 function updateDecryptResults(secret) {
   decryptResultDiv.querySelector(".copy-me").textContent = secret;
   showElement(decryptResultDiv);
 }
 
+function updateManageResults(status) {
+  const expiryTxt = new Date(status.expire_at).toLocaleString();
+  let stateTxt;
+  switch (status.state) {
+    case "pending":
+      stateTxt = `is waiting to be recovered, and will expire on ${expiryTxt} if not used.`;
+      break;
+    case "retrieved":
+      stateTxt = "has been recovered.";
+      break;
+    case "expired":
+      stateTxt = `expired, without being recovered, on ${expiryTxt}.`;
+      break;
+    case "revoked":
+      stateTxt = "has been revoked.";
+      break;
+    default:
+      stateTxt = `is ${status.state}.`;
+  }
+  manageResultDiv.querySelector(".secret-state").textContent = stateTxt;
+  if (status.state === "pending") {
+    showElement(revokeButton.parentElement);
+  } else {
+    hideElement(revokeButton.parentElement);
+  }
+  showElement(manageResultDiv);
+}
+
+function handleManageAction(action) {
+  hideElement(errorAlert);
+  hideElement(manageResultDiv);
+  disableForm(manageForm);
+
+  manageSecret(action, manageToken.value)
+    .then((status) => {
+      updateManageResults(status);
+      enableForm(manageForm);
+    })
+    .catch((ex) => {
+      console.error(ex);
+      updateErrorAlert(ex.toString());
+      enableForm(manageForm);
+    });
+}
+
 encryptForm.addEventListener("submit", (evt) => {
   evt.preventDefault();
 
   const secret = document.getElementById("encrypt-value").value;
   const ttl = document.getElementById("encrypt-ttl").value;
+  const notify = document.getElementById("encrypt-notify").value.trim();
   const pwd = createPassword();
 
   hideElement(errorAlert);
@@ -156,10 +273,10 @@ encryptForm.addEventListener("submit", (evt) => {
 
   encryptSecret(pwd, secret)
     .then((cipherText) => {
-      return setSecret(cipherText, ttl);
+      return setSecret(cipherText, ttl, notify);
     })
-    .then((secretKey) => {
-      updateEncryptResults(pwd, secretKey, ttl);
+    .then((created) => {
+      updateEncryptResults(pwd, created, ttl);
       enableForm(encryptForm);
     })
     .catch((ex) => {
@@ -169,30 +286,65 @@ encryptForm.addEventListener("submit", (evt) => {
     });
 });
 
+function handlePeek() {
+  const shared = parseDecryptKey();
+
+  hideElement(errorAlert);
+  hideElement(peekResultDiv);
+  hideElement(decryptResultDiv);
+  disableForm(decryptForm);
+
+  peekSecret(shared.key)
+    .then((peek) => {
+      updatePeekResults(peek);
+      enableForm(decryptForm);
+    })
+    .catch((ex) => {
+      console.error(ex);
+      updateErrorAlert(ex.toString());
+      enableForm(decryptForm);
+    });
+}
+
 decryptForm.addEventListener("submit", (evt) => {
   evt.preventDefault();
+  handlePeek();
+});
 
+revealButton.addEventListener("click", () => {
   const shared = parseDecryptKey();
 
   hideElement(errorAlert);
-  hideElement(decryptResultDiv);
   disableForm(decryptForm);
+  revealButton.disabled = true;
 
   getSecret(shared.key)
     .then((cipherText) => {
       return decryptSecret(shared.pwd, cipherText);
     })
     .then((secret) => {
+      hideElement(peekResultDiv);
       updateDecryptResults(secret);
       enableForm(decryptForm);
+      revealButton.disabled = false;
     })
     .catch((ex) => {
       console.error(ex);
       updateErrorAlert(ex.toString());
       enableForm(decryptForm);
+      revealButton.disabled = false;
     });
 });
 
+manageForm.addEventListener("submit", (evt) => {
+  evt.preventDefault();
+  handleManageAction("status");
+});
+
+revokeButton.addEventListener("click", () => {
+  handleManageAction("revoke");
+});
+
 decryptKey.addEventListener("input", () => {
   if (decryptKey.validity.patternMismatch) {
     decryptKey.setCustomValidity("Invalid shared key.");
@@ -224,14 +376,22 @@ document.querySelectorAll("#tab-row button").forEach((btn) => {
   });
 });
 
-if (setDecryptKeyFromLocation()) {
+function activateTab(name) {
   document.querySelectorAll("#encrypt-tab-btn, #encrypt-tab").forEach((elt) => {
     elt.classList.remove("active");
   });
-  document.querySelectorAll("#decrypt-tab-btn, #decrypt-tab").forEach((elt) => {
+  document.querySelectorAll(`#${name}-tab-btn, #${name}-tab`).forEach((elt) => {
     elt.classList.add("active");
   });
-  document.querySelector("#decrypt-tab .focus-target").focus();
+  document.querySelector(`#${name}-tab .focus-target`).focus();
+}
+
+if (setDecryptKeyFromLocation()) {
+  activateTab("decrypt");
+  handlePeek();
+} else if (setManageTokenFromLocation()) {
+  activateTab("manage");
+  handleManageAction("status");
 } else {
   document.querySelector("#encrypt-tab .focus-target").focus();
 }
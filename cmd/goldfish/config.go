@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Problems found in the configuration file, which are only reported
+// when the configuration is checked, so that "config validate" can
+// list all of them at once.
+var configProblems []error
+
+// loadConfigFile fills in every option that has not been set by a flag or
+// an environment variable, using the option's flag name as its file key.
+func loadConfigFile(cmd *cli.Command) error {
+	configProblems = nil
+	if configFile == "" {
+		return nil
+	}
+	values, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !configurable(cmd, key) {
+			configProblems = append(configProblems, fmt.Errorf("%s: unknown key %q", configFile, key))
+			continue
+		}
+		if cmd.IsSet(key) {
+			continue
+		}
+		value, err := configValue(values[key])
+		if err == nil {
+			err = cmd.Set(key, value)
+		}
+		if err != nil {
+			configProblems = append(configProblems, fmt.Errorf("%s: invalid %q: %w", configFile, key, err))
+		}
+	}
+	return nil
+}
+
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("%s: config file must be .yaml, .yml, or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func configurable(cmd *cli.Command, key string) bool {
+	switch key {
+	case "config", "help", "version":
+		return false
+	}
+	for _, flag := range cmd.Flags {
+		if slices.Contains(flag.Names(), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// configValue turns file values into flag values, so
+// that lists become the comma-separated form of flags.
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", errors.New("nested values are not supported")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// checkConfig reports problems with the configuration file, and
+// option values that would otherwise only fail when first used.
+func checkConfig() error {
+	problems := slices.Clone(configProblems)
+	check := func(name, value string, allowed ...string) {
+		if !slices.Contains(allowed, value) {
+			problems = append(problems, fmt.Errorf("invalid %s %q, must be one of %q", name, value, allowed))
+		}
+	}
+	check("log-level", logLevel, "debug", "info", "warn", "error")
+	check("log-format", logFormat, "plain", "text", "json")
+	problems = append(problems, cfg.Validate())
+	return errors.Join(problems...)
+}
+
+func validateConfig(_ context.Context, cmd *cli.Command) error {
+	err := checkConfig()
+	if err == nil {
+		fmt.Fprintln(cmd.Root().Writer, "Configuration is valid")
+		return nil
+	}
+	for _, problem := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintln(cmd.Root().ErrWriter, problem)
+	}
+	return errors.New("configuration is not valid")
+}
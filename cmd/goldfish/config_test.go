@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v3"
+	"gotest.tools/v3/assert"
+
+	"github.com/digitalocean-labs/goldfish/server"
+)
+
+func testConfigCommand(t *testing.T, path string, args ...string) (string, string, string, time.Duration) {
+	var addr, backend, headers string
+	var poll time.Duration
+	configFile = path
+	defer func() { configFile = "" }()
+
+	cmd := &cli.Command{
+		Name: "goldfish",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "addr", Value: ":3000", Destination: &addr, Sources: cli.EnvVars("TEST_LISTEN_ADDR")},
+			&cli.StringFlag{Name: "backend", Value: "sqlite", Destination: &backend, Sources: cli.EnvVars("TEST_BACKEND_STORE")},
+			&cli.StringFlag{Name: "limit-headers", Destination: &headers},
+			&cli.DurationFlag{Name: "notify-poll", Value: time.Minute, Destination: &poll},
+		},
+		Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+			return ctx, loadConfigFile(cmd)
+		},
+		Action: func(context.Context, *cli.Command) error { return nil },
+	}
+	assert.NilError(t, cmd.Run(context.Background(), append([]string{"goldfish"}, args...)))
+	return addr, backend, headers, poll
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goldfish.yaml")
+	config := "addr: \":4000\"\nbackend: redis\nlimit-headers:\n  - X-Real-IP\n  - X-Forwarded-For\nnotify-poll: 5m\n"
+	assert.NilError(t, os.WriteFile(path, []byte(config), 0o600))
+
+	addr, backend, headers, poll := testConfigCommand(t, path)
+	assert.Equal(t, ":4000", addr)
+	assert.Equal(t, "redis", backend)
+	assert.Equal(t, "X-Real-IP,X-Forwarded-For", headers)
+	assert.Equal(t, 5*time.Minute, poll)
+	assert.Assert(t, len(configProblems) == 0)
+
+	t.Setenv("TEST_LISTEN_ADDR", ":5000")
+	t.Setenv("TEST_BACKEND_STORE", "sqlite")
+	addr, backend, _, _ = testConfigCommand(t, path, "--addr", ":6000")
+	assert.Equal(t, ":6000", addr)
+	assert.Equal(t, "sqlite", backend)
+}
+
+func TestConfigFileProblems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goldfish.toml")
+	config := "backend = \"mongo\"\nnotify-poll = \"often\"\nwibble = true\n"
+	assert.NilError(t, os.WriteFile(path, []byte(config), 0o600))
+
+	_, backend, _, _ := testConfigCommand(t, path)
+	assert.Equal(t, "mongo", backend)
+	assert.Equal(t, 2, len(configProblems))
+	assert.ErrorContains(t, configProblems[0], `invalid "notify-poll"`)
+	assert.ErrorContains(t, configProblems[1], `unknown key "wibble"`)
+
+	cfg.Backend, cfg.RedisTLS = "mongo", "maybe"
+	defer func() { cfg = server.Config{} }()
+	err := checkConfig()
+	assert.ErrorContains(t, err, `invalid backend "mongo"`)
+	assert.ErrorContains(t, err, `invalid redis-tls "maybe"`)
+	assert.ErrorContains(t, err, `unknown key "wibble"`)
+
+	path = filepath.Join(t.TempDir(), "goldfish.ini")
+	assert.NilError(t, os.WriteFile(path, []byte(config), 0o600))
+	_, err = readConfigFile(path)
+	assert.ErrorContains(t, err, "must be .yaml, .yml, or .toml")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	log "log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/digitalocean-labs/goldfish/server"
+)
+
+func watchCredentialFiles(ctx context.Context, srv *server.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			srv.ReloadCredentials()
+			serverCert.reload()
+		}
+	}
+}
+
+// serverCert lets the HTTPS listener pick up a renewed
+// certificate and private key without a restart.
+var serverCert certReloader
+
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) reload() {
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return
+	}
+	if err := c.load(); err != nil {
+		log.Warn("Failed to reload TLS certificate", "err", err)
+		return
+	}
+	log.Info("Reloaded TLS certificate")
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
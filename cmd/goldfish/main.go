@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	log "log/slog"
@@ -15,29 +17,19 @@ import (
 	"github.com/tomcz/gotools/errgroup"
 	"github.com/tomcz/gotools/quiet"
 	"github.com/urfave/cli/v3"
+
+	"github.com/digitalocean-labs/goldfish/server"
 )
 
 var (
-	listenAddr   string
-	pidFilePath  string
-	breakerRatio float64
+	configFile  string
+	listenAddr  string
+	pidFilePath string
 
 	tlsCertFile string
 	tlsKeyFile  string
 
-	limitCount   uint64
-	limitPeriod  time.Duration
-	limitHeaders string
-
-	storeType        string
-	storeSqliteFile  string
-	storeSqliteClean time.Duration
-	storeRedisAddr   string
-	storeRedisUser   string
-	storeRedisPass   string
-	storeRedisDB     int
-	storeRedisNS     string
-	storeRedisTLS    string
+	cfg server.Config
 
 	logLevel  string
 	logFormat string
@@ -48,13 +40,8 @@ var (
 )
 
 const (
-	gracefulTimeout  = 100 * time.Millisecond
-	skipPidFile      = "skip"
-	sqliteStoreType  = "sqlite"
-	redisStoreType   = "redis"
-	redisTlsOn       = "on"
-	redisTlsOff      = "off"
-	redisTlsInsecure = "insecure"
+	gracefulTimeout = 100 * time.Millisecond
+	skipPidFile     = "skip"
 )
 
 func main() {
@@ -63,15 +50,83 @@ func main() {
 		log.Error("Unable to determine executable path", "err", err)
 		os.Exit(1)
 	}
+	defaults := server.DefaultConfig()
 	app := &cli.Command{
 		Name:            "goldfish",
 		Usage:           "Webapp for browser-based one-time secret management",
 		ArgsUsage:       " ", // no positional arguments
-		Before:          setupLogging,
+		Before:          setupConfig,
 		Action:          startService,
 		Version:         version,
 		HideHelpCommand: true,
+		Commands: []*cli.Command{
+			{
+				Name:   "rekey",
+				Usage:  "Re-encrypt stored secrets with the primary encryption key",
+				Action: rekeySecrets,
+			},
+			{
+				Name:   "stats",
+				Usage:  "Count the secrets in the backend, without their keys or values",
+				Action: printStats,
+			},
+			{
+				Name:  "migrate",
+				Usage: "Move unexpired secrets from one backend to another",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "from",
+						Usage:       "Source `backend`, either sqlite:path, or a redis://, rediss://, or unix:// url",
+						Required:    true,
+						Destination: &migrateFrom,
+					},
+					&cli.StringFlag{
+						Name:        "to",
+						Usage:       "Destination `backend`, either sqlite:path, or a redis://, rediss://, or unix:// url",
+						Required:    true,
+						Destination: &migrateTo,
+					},
+				},
+				Action: migrateSecrets,
+			},
+			{
+				Name:            "db",
+				Usage:           "Manage the schema of the SQLite database",
+				HideHelpCommand: true,
+				Commands: []*cli.Command{
+					{
+						Name:   "migrate",
+						Usage:  "Apply pending schema migrations",
+						Action: migrateDatabase,
+					},
+					{
+						Name:   "status",
+						Usage:  "Report the schema version and pending migrations",
+						Action: databaseStatus,
+					},
+				},
+			},
+			{
+				Name:            "config",
+				Usage:           "Check the configuration",
+				HideHelpCommand: true,
+				Commands: []*cli.Command{
+					{
+						Name:   "validate",
+						Usage:  "Report unknown configuration file keys and invalid option values",
+						Action: validateConfig,
+					},
+				},
+			},
+		},
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "config",
+				Usage:       "YAML or TOML configuration `file` path, for options not set by flags or environment variables",
+				Category:    "Application",
+				Destination: &configFile,
+				Sources:     cli.EnvVars("CONFIG_FILE"),
+			},
 			&cli.StringFlag{
 				Name:        "addr",
 				Usage:       "Server listen address",
@@ -91,79 +146,401 @@ func main() {
 			&cli.Float64Flag{
 				Name:        "breaker-ratio",
 				Usage:       "Circuit-breaker failure ratio; zero or less to disable the circuit-breaker",
-				Value:       0.1,
+				Value:       defaults.BreakerRatio,
 				Category:    "Application",
-				Destination: &breakerRatio,
+				Destination: &cfg.BreakerRatio,
 				Sources:     cli.EnvVars("BREAKER_RATIO"),
 			},
 			&cli.StringFlag{
 				Name:        "backend",
-				Usage:       fmt.Sprintf("Backend to use for secret `storage`, either %q or %q", sqliteStoreType, redisStoreType),
-				Value:       sqliteStoreType,
+				Usage:       fmt.Sprintf("Backend to use for secret `storage`, one of %q", server.StoreNames()),
+				Value:       defaults.Backend,
 				Category:    "Application",
-				Destination: &storeType,
+				Destination: &cfg.Backend,
 				Sources:     cli.EnvVars("BACKEND_STORE"),
 			},
+			&cli.StringFlag{
+				Name:        "allowed-cidrs",
+				Usage:       "Comma-separated `list` of networks that senders can restrict the retrieval of their secrets to",
+				Category:    "Application",
+				Destination: &cfg.AllowedCIDRs,
+				Sources:     cli.EnvVars("ALLOWED_CIDRS"),
+			},
 			&cli.StringFlag{
 				Name:        "sqlite-file",
 				Usage:       "Database file `path`",
 				Value:       fmt.Sprintf("%s.db", pname),
 				Category:    "SQLite backend",
-				Destination: &storeSqliteFile,
+				Destination: &cfg.SqliteFile,
 				Sources:     cli.EnvVars("SQLITE_FILE"),
 			},
 			&cli.DurationFlag{
 				Name:        "sqlite-clean",
 				Usage:       "Interval for removal of unaccessed expired secrets",
-				Value:       time.Hour,
+				Value:       defaults.SqliteClean,
 				Category:    "SQLite backend",
-				Destination: &storeSqliteClean,
+				Destination: &cfg.SqliteClean,
 				Sources:     cli.EnvVars("SQLITE_CLEAN"),
 			},
+			&cli.StringFlag{
+				Name:        "sqlite-journal-mode",
+				Usage:       "Journal `mode`, one of \"delete\", \"truncate\", \"persist\", \"memory\", \"wal\", or \"off\"",
+				Value:       defaults.SqliteJournalMode,
+				Category:    "SQLite backend",
+				Destination: &cfg.SqliteJournalMode,
+				Sources:     cli.EnvVars("SQLITE_JOURNAL_MODE"),
+			},
+			&cli.StringFlag{
+				Name:        "sqlite-synchronous",
+				Usage:       "Synchronous `level`, one of \"off\", \"normal\", \"full\", or \"extra\"",
+				Value:       defaults.SqliteSynchronous,
+				Category:    "SQLite backend",
+				Destination: &cfg.SqliteSynchronous,
+				Sources:     cli.EnvVars("SQLITE_SYNCHRONOUS"),
+			},
+			&cli.DurationFlag{
+				Name:        "sqlite-busy-timeout",
+				Usage:       "Time to wait for a locked database before failing",
+				Value:       defaults.SqliteBusyTimeout,
+				Category:    "SQLite backend",
+				Destination: &cfg.SqliteBusyTimeout,
+				Sources:     cli.EnvVars("SQLITE_BUSY_TIMEOUT"),
+			},
+			&cli.IntFlag{
+				Name:        "sqlite-max-open-conns",
+				Usage:       "Maximum number of open database connections; zero for no limit",
+				Value:       defaults.SqliteMaxOpenConns,
+				Category:    "SQLite backend",
+				Destination: &cfg.SqliteMaxOpenConns,
+				Sources:     cli.EnvVars("SQLITE_MAX_OPEN_CONNS"),
+			},
+			&cli.IntFlag{
+				Name:        "sqlite-max-idle-conns",
+				Usage:       "Maximum number of idle database connections",
+				Value:       defaults.SqliteMaxIdleConns,
+				Category:    "SQLite backend",
+				Destination: &cfg.SqliteMaxIdleConns,
+				Sources:     cli.EnvVars("SQLITE_MAX_IDLE_CONNS"),
+			},
+			&cli.IntFlag{
+				Name:        "memory-max-bytes",
+				Usage:       "Maximum total size of stored secrets; zero or less for no limit",
+				Value:       defaults.MemoryMaxBytes,
+				Category:    "Memory backend",
+				Destination: &cfg.MemoryMaxBytes,
+				Sources:     cli.EnvVars("MEMORY_MAX_BYTES"),
+			},
+			&cli.DurationFlag{
+				Name:        "memory-clean",
+				Usage:       "Interval for removal of unaccessed expired secrets",
+				Value:       defaults.MemoryClean,
+				Category:    "Memory backend",
+				Destination: &cfg.MemoryClean,
+				Sources:     cli.EnvVars("MEMORY_CLEAN"),
+			},
+			&cli.StringFlag{
+				Name:        "redis-url",
+				Usage:       "Redis `url`, either redis://, rediss://, or unix://, to use instead of the address, credential, db, namespace, and TLS options",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisURL,
+				Sources:     cli.EnvVars("REDIS_URL"),
+			},
+			&cli.StringFlag{
+				Name:        "redis-url-file",
+				Usage:       "Redis url file `path`; credentials in the url are reloaded on SIGHUP",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisURLFile,
+				Sources:     cli.EnvVars("REDIS_URL_FILE"),
+			},
 			&cli.StringFlag{
 				Name:        "redis-addr",
-				Usage:       "Redis address",
-				Value:       "localhost:6379",
+				Usage:       "Redis address, or comma-separated sentinel or cluster node addresses",
+				Value:       defaults.RedisAddr,
 				Category:    "Redis backend",
-				Destination: &storeRedisAddr,
+				Destination: &cfg.RedisAddr,
 				Sources:     cli.EnvVars("REDIS_ADDR"),
 			},
+			&cli.StringFlag{
+				Name:        "redis-mode",
+				Usage:       fmt.Sprintf("Either %q, %q, or %q", server.RedisModeStandalone, server.RedisModeSentinel, server.RedisModeCluster),
+				Value:       defaults.RedisMode,
+				Category:    "Redis backend",
+				Destination: &cfg.RedisMode,
+				Sources:     cli.EnvVars("REDIS_MODE"),
+			},
+			&cli.StringFlag{
+				Name:        "redis-sentinel-master",
+				Usage:       "Master `name` to ask the sentinels for",
+				Value:       defaults.RedisSentinelMaster,
+				Category:    "Redis backend",
+				Destination: &cfg.RedisSentinelMaster,
+				Sources:     cli.EnvVars("REDIS_SENTINEL_MASTER"),
+			},
 			&cli.StringFlag{
 				Name:        "redis-user",
 				Usage:       "Redis username, if required",
 				Category:    "Redis backend",
-				Destination: &storeRedisUser,
+				Destination: &cfg.RedisUser,
 				Sources:     cli.EnvVars("REDIS_USER"),
 			},
 			&cli.StringFlag{
 				Name:        "redis-pass",
 				Usage:       "Redis password, if required",
 				Category:    "Redis backend",
-				Destination: &storeRedisPass,
+				Destination: &cfg.RedisPass,
 				Sources:     cli.EnvVars("REDIS_PASS"),
 			},
+			&cli.StringFlag{
+				Name:        "redis-pass-file",
+				Usage:       "Redis password file `path`, reloaded on SIGHUP",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisPassFile,
+				Sources:     cli.EnvVars("REDIS_PASS_FILE"),
+			},
 			&cli.IntFlag{
 				Name:        "redis-db",
 				Usage:       "Redis db `number`, if required",
 				Category:    "Redis backend",
-				Destination: &storeRedisDB,
+				Destination: &cfg.RedisDB,
 				Sources:     cli.EnvVars("REDIS_DB"),
 			},
 			&cli.StringFlag{
 				Name:        "redis-ns",
 				Usage:       "Redis namespace, if required",
 				Category:    "Redis backend",
-				Destination: &storeRedisNS,
+				Destination: &cfg.RedisNS,
 				Sources:     cli.EnvVars("REDIS_NS"),
 			},
 			&cli.StringFlag{
 				Name:        "redis-tls",
-				Usage:       fmt.Sprintf("Either %q, %q, or %q", redisTlsOff, redisTlsOn, redisTlsInsecure),
-				Value:       redisTlsOff,
+				Usage:       fmt.Sprintf("Either %q, %q, or %q", server.RedisTLSOff, server.RedisTLSOn, server.RedisTLSInsecure),
+				Value:       defaults.RedisTLS,
 				Category:    "Redis backend",
-				Destination: &storeRedisTLS,
+				Destination: &cfg.RedisTLS,
 				Sources:     cli.EnvVars("REDIS_TLS"),
 			},
+			&cli.StringFlag{
+				Name:        "redis-ca-file",
+				Usage:       "CA certificates `file` to verify the Redis server, instead of the system roots",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisCAFile,
+				Sources:     cli.EnvVars("REDIS_CA_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "redis-cert-file",
+				Usage:       "Client TLS certificate `file` path, if required",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisCertFile,
+				Sources:     cli.EnvVars("REDIS_CERT_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "redis-key-file",
+				Usage:       "Client TLS private key `file` path, if required",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisKeyFile,
+				Sources:     cli.EnvVars("REDIS_KEY_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "redis-server-name",
+				Usage:       "Server `name` to verify, if different from the Redis host",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisServerName,
+				Sources:     cli.EnvVars("REDIS_SERVER_NAME"),
+			},
+			&cli.IntFlag{
+				Name:        "redis-max-idle",
+				Usage:       "Maximum `number` of idle Redis connections",
+				Value:       defaults.RedisMaxIdle,
+				Category:    "Redis backend",
+				Destination: &cfg.RedisMaxIdle,
+				Sources:     cli.EnvVars("REDIS_MAX_IDLE"),
+			},
+			&cli.IntFlag{
+				Name:        "redis-max-active",
+				Usage:       "Maximum `number` of open Redis connections; zero for no limit",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisMaxActive,
+				Sources:     cli.EnvVars("REDIS_MAX_ACTIVE"),
+			},
+			&cli.BoolFlag{
+				Name:        "redis-wait",
+				Usage:       "Wait for a free Redis connection, rather than fail, when the maximum is reached",
+				Category:    "Redis backend",
+				Destination: &cfg.RedisWait,
+				Sources:     cli.EnvVars("REDIS_WAIT"),
+			},
+			&cli.DurationFlag{
+				Name:        "redis-idle-timeout",
+				Usage:       "Close Redis connections after remaining idle for this `time`",
+				Value:       defaults.RedisIdleTimeout,
+				Category:    "Redis backend",
+				Destination: &cfg.RedisIdleTimeout,
+				Sources:     cli.EnvVars("REDIS_IDLE_TIMEOUT"),
+			},
+			&cli.DurationFlag{
+				Name:        "redis-connect-timeout",
+				Usage:       "Timeout for connecting to Redis",
+				Value:       defaults.RedisConnectTimeout,
+				Category:    "Redis backend",
+				Destination: &cfg.RedisConnectTimeout,
+				Sources:     cli.EnvVars("REDIS_CONNECT_TIMEOUT"),
+			},
+			&cli.DurationFlag{
+				Name:        "redis-read-timeout",
+				Usage:       "Timeout for reading a Redis reply",
+				Value:       defaults.RedisReadTimeout,
+				Category:    "Redis backend",
+				Destination: &cfg.RedisReadTimeout,
+				Sources:     cli.EnvVars("REDIS_READ_TIMEOUT"),
+			},
+			&cli.DurationFlag{
+				Name:        "redis-write-timeout",
+				Usage:       "Timeout for writing a Redis command",
+				Value:       defaults.RedisWriteTimeout,
+				Category:    "Redis backend",
+				Destination: &cfg.RedisWriteTimeout,
+				Sources:     cli.EnvVars("REDIS_WRITE_TIMEOUT"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-endpoints",
+				Usage:       "Comma-separated etcd client `urls`",
+				Value:       defaults.EtcdEndpoints,
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdEndpoints,
+				Sources:     cli.EnvVars("ETCD_ENDPOINTS"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-ns",
+				Usage:       "etcd key prefix, like the Redis namespace, if required",
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdNS,
+				Sources:     cli.EnvVars("ETCD_NS"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-user",
+				Usage:       "etcd username, if required",
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdUser,
+				Sources:     cli.EnvVars("ETCD_USER"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-pass",
+				Usage:       "etcd password, if required",
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdPass,
+				Sources:     cli.EnvVars("ETCD_PASS"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-pass-file",
+				Usage:       "etcd password file `path`, reloaded on SIGHUP",
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdPassFile,
+				Sources:     cli.EnvVars("ETCD_PASS_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-ca-file",
+				Usage:       "CA certificates `file` to verify the etcd servers, instead of the system roots",
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdCAFile,
+				Sources:     cli.EnvVars("ETCD_CA_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-cert-file",
+				Usage:       "Client TLS certificate `file` path, if required",
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdCertFile,
+				Sources:     cli.EnvVars("ETCD_CERT_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "etcd-key-file",
+				Usage:       "Client TLS private key `file` path, if required",
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdKeyFile,
+				Sources:     cli.EnvVars("ETCD_KEY_FILE"),
+			},
+			&cli.DurationFlag{
+				Name:        "etcd-dial-timeout",
+				Usage:       "Timeout for connecting to etcd",
+				Value:       defaults.EtcdDialTimeout,
+				Category:    "etcd backend",
+				Destination: &cfg.EtcdDialTimeout,
+				Sources:     cli.EnvVars("ETCD_DIAL_TIMEOUT"),
+			},
+			&cli.StringFlag{
+				Name:        "s3-bucket",
+				Usage:       "S3-compatible `bucket` for large secrets, which are otherwise kept in the backend",
+				Category:    "S3 payloads",
+				Destination: &cfg.S3Bucket,
+				Sources:     cli.EnvVars("S3_BUCKET"),
+			},
+			&cli.StringFlag{
+				Name:        "s3-endpoint",
+				Usage:       "S3 endpoint `url`, either http:// or https://",
+				Value:       defaults.S3Endpoint,
+				Category:    "S3 payloads",
+				Destination: &cfg.S3Endpoint,
+				Sources:     cli.EnvVars("S3_ENDPOINT"),
+			},
+			&cli.StringFlag{
+				Name:        "s3-region",
+				Usage:       "S3 region, if required",
+				Category:    "S3 payloads",
+				Destination: &cfg.S3Region,
+				Sources:     cli.EnvVars("S3_REGION"),
+			},
+			&cli.StringFlag{
+				Name:        "s3-prefix",
+				Usage:       "Name prefix of the objects in the bucket",
+				Value:       defaults.S3Prefix,
+				Category:    "S3 payloads",
+				Destination: &cfg.S3Prefix,
+				Sources:     cli.EnvVars("S3_PREFIX"),
+			},
+			&cli.StringFlag{
+				Name:        "s3-access-key",
+				Usage:       "S3 access key ID",
+				Category:    "S3 payloads",
+				Destination: &cfg.S3AccessKey,
+				Sources:     cli.EnvVars("S3_ACCESS_KEY"),
+			},
+			&cli.StringFlag{
+				Name:        "s3-secret-key",
+				Usage:       "S3 secret access key",
+				Category:    "S3 payloads",
+				Destination: &cfg.S3SecretKey,
+				Sources:     cli.EnvVars("S3_SECRET_KEY"),
+			},
+			&cli.StringFlag{
+				Name:        "s3-secret-key-file",
+				Usage:       "S3 secret access key file `path`, reloaded on SIGHUP",
+				Category:    "S3 payloads",
+				Destination: &cfg.S3SecretKeyFile,
+				Sources:     cli.EnvVars("S3_SECRET_KEY_FILE"),
+			},
+			&cli.IntFlag{
+				Name:        "s3-min-bytes",
+				Usage:       "Minimum size of the secrets that are kept in the bucket",
+				Value:       defaults.S3MinBytes,
+				Category:    "S3 payloads",
+				Destination: &cfg.S3MinBytes,
+				Sources:     cli.EnvVars("S3_MIN_BYTES"),
+			},
+			&cli.IntFlag{
+				Name:        "s3-max-bytes",
+				Usage:       "Maximum size of secrets, when a bucket is used",
+				Value:       defaults.S3MaxBytes,
+				Category:    "S3 payloads",
+				Destination: &cfg.S3MaxBytes,
+				Sources:     cli.EnvVars("S3_MAX_BYTES"),
+			},
+			&cli.DurationFlag{
+				Name:        "s3-sweep",
+				Usage:       "Interval for removal of the objects of expired secrets",
+				Value:       defaults.S3Sweep,
+				Category:    "S3 payloads",
+				Destination: &cfg.S3Sweep,
+				Sources:     cli.EnvVars("S3_SWEEP"),
+			},
 			&cli.StringFlag{
 				Name:        "tls-cert",
 				Usage:       "Server TLS certificate `file` path",
@@ -181,26 +558,199 @@ func main() {
 			&cli.Uint64Flag{
 				Name:        "limit-count",
 				Usage:       "Maximum `number` of requests, per IP; zero to disable the limiter",
-				Value:       1000,
+				Value:       defaults.LimitCount,
 				Category:    "Rate-limiter",
-				Destination: &limitCount,
+				Destination: &cfg.LimitCount,
 				Sources:     cli.EnvVars("RATE_LIMIT_COUNT"),
 			},
 			&cli.DurationFlag{
 				Name:        "limit-period",
 				Usage:       "Window of `time` for requests, per IP",
-				Value:       time.Hour,
+				Value:       defaults.LimitPeriod,
 				Category:    "Rate-limiter",
-				Destination: &limitPeriod,
+				Destination: &cfg.LimitPeriod,
 				Sources:     cli.EnvVars("RATE_LIMIT_PERIOD"),
 			},
 			&cli.StringFlag{
 				Name:        "limit-headers",
 				Usage:       "Comma-separated `list` of http request headers that can provide an IP address",
 				Category:    "Rate-limiter",
-				Destination: &limitHeaders,
+				Destination: &cfg.LimitHeaders,
 				Sources:     cli.EnvVars("RATE_LIMIT_HEADERS"),
 			},
+			&cli.StringFlag{
+				Name:        "admin-token",
+				Usage:       "Bearer `token` for the admin endpoints, which are disabled without it",
+				Category:    "Admin",
+				Destination: &cfg.AdminToken,
+				Sources:     cli.EnvVars("ADMIN_TOKEN"),
+			},
+			&cli.StringFlag{
+				Name:        "admin-token-file",
+				Usage:       "Admin token file `path`, reloaded on SIGHUP",
+				Category:    "Admin",
+				Destination: &cfg.AdminTokenFile,
+				Sources:     cli.EnvVars("ADMIN_TOKEN_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "audit-file",
+				Usage:       "Append secret lifecycle events, as JSON lines, to this file `path`",
+				Category:    "Audit log",
+				Destination: &cfg.AuditFile,
+				Sources:     cli.EnvVars("AUDIT_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "audit-syslog",
+				Usage:       fmt.Sprintf("Send secret lifecycle events to syslog; either %q, or a \"udp://host:port\" or \"tcp://host:port\" `address`", server.AuditSyslogLocal),
+				Category:    "Audit log",
+				Destination: &cfg.AuditSyslog,
+				Sources:     cli.EnvVars("AUDIT_SYSLOG"),
+			},
+			&cli.StringFlag{
+				Name:        "audit-webhook",
+				Usage:       "POST secret lifecycle events, as JSON, to this `url`",
+				Category:    "Audit log",
+				Destination: &cfg.AuditWebhook,
+				Sources:     cli.EnvVars("AUDIT_WEBHOOK"),
+			},
+			&cli.StringFlag{
+				Name:        "audit-hash-key",
+				Usage:       "Secret `key` for the hashes of secret keys and client IP addresses in audit events; a random key is used if it is not set",
+				Category:    "Audit log",
+				Destination: &cfg.AuditHashKey,
+				Sources:     cli.EnvVars("AUDIT_HASH_KEY"),
+			},
+			&cli.StringFlag{
+				Name:        "audit-hash-key-file",
+				Usage:       "Audit hash key file `path`, reloaded on SIGHUP",
+				Category:    "Audit log",
+				Destination: &cfg.AuditHashKeyFile,
+				Sources:     cli.EnvVars("AUDIT_HASH_KEY_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "audit-user-header",
+				Usage:       "Http request `header` that identifies the creator of a secret, as set by an authenticating proxy",
+				Category:    "Audit log",
+				Destination: &cfg.AuditUserHeader,
+				Sources:     cli.EnvVars("AUDIT_USER_HEADER"),
+			},
+			&cli.BoolFlag{
+				Name:        "notify-webhooks",
+				Usage:       "Allow secret creators to be notified via https webhook or Slack-compatible incoming webhook urls on public addresses",
+				Category:    "Notifications",
+				Destination: &cfg.NotifyWebhooks,
+				Sources:     cli.EnvVars("NOTIFY_WEBHOOKS"),
+			},
+			&cli.StringFlag{
+				Name:        "notify-mail-domains",
+				Usage:       "Comma-separated `list` of the domains, or email addresses, that email notifications can be sent to",
+				Category:    "Notifications",
+				Destination: &cfg.NotifyMailDomains,
+				Sources:     cli.EnvVars("NOTIFY_MAIL_DOMAINS"),
+			},
+			&cli.StringFlag{
+				Name:        "notify-smtp-addr",
+				Usage:       "SMTP server `address` to allow secret creators to be notified via email",
+				Category:    "Notifications",
+				Destination: &cfg.NotifySmtpAddr,
+				Sources:     cli.EnvVars("NOTIFY_SMTP_ADDR"),
+			},
+			&cli.StringFlag{
+				Name:        "notify-smtp-from",
+				Usage:       "Sender email `address` for notifications",
+				Value:       defaults.NotifySmtpFrom,
+				Category:    "Notifications",
+				Destination: &cfg.NotifySmtpFrom,
+				Sources:     cli.EnvVars("NOTIFY_SMTP_FROM"),
+			},
+			&cli.StringFlag{
+				Name:        "notify-smtp-user",
+				Usage:       "SMTP username, if required",
+				Category:    "Notifications",
+				Destination: &cfg.NotifySmtpUser,
+				Sources:     cli.EnvVars("NOTIFY_SMTP_USER"),
+			},
+			&cli.StringFlag{
+				Name:        "notify-smtp-pass",
+				Usage:       "SMTP password, if required",
+				Category:    "Notifications",
+				Destination: &cfg.NotifySmtpPass,
+				Sources:     cli.EnvVars("NOTIFY_SMTP_PASS"),
+			},
+			&cli.StringFlag{
+				Name:        "notify-smtp-pass-file",
+				Usage:       "SMTP password file `path`, reloaded on SIGHUP",
+				Category:    "Notifications",
+				Destination: &cfg.NotifySmtpPassFile,
+				Sources:     cli.EnvVars("NOTIFY_SMTP_PASS_FILE"),
+			},
+			&cli.DurationFlag{
+				Name:        "notify-poll",
+				Usage:       "Interval for detection of expired secrets in the Redis and etcd backends",
+				Value:       defaults.NotifyPoll,
+				Category:    "Notifications",
+				Destination: &cfg.NotifyPoll,
+				Sources:     cli.EnvVars("NOTIFY_POLL"),
+			},
+			&cli.StringFlag{
+				Name:        "key-provider",
+				Usage:       fmt.Sprintf("Source of server keys for encryption of stored secrets, either %q or %q", server.FileKeyProvider, server.VaultKeyProvider),
+				Value:       defaults.KeyProvider,
+				Category:    "Encryption at rest",
+				Destination: &cfg.KeyProvider,
+				Sources:     cli.EnvVars("KEY_PROVIDER"),
+			},
+			&cli.StringFlag{
+				Name:        "encryption-keys",
+				Usage:       "Comma-separated `list` of id=base64 32-byte keys for encryption of stored secrets; the first key encrypts new secrets",
+				Category:    "Encryption at rest",
+				Destination: &cfg.EncryptionKeys,
+				Sources:     cli.EnvVars("ENCRYPTION_KEYS"),
+			},
+			&cli.StringFlag{
+				Name:        "encryption-keys-file",
+				Usage:       "File `path` of id=base64 keys, one per line, read after any encryption-keys",
+				Category:    "Encryption at rest",
+				Destination: &cfg.EncryptionKeysFile,
+				Sources:     cli.EnvVars("ENCRYPTION_KEYS_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "vault-addr",
+				Usage:       "Vault server `url`",
+				Category:    "Encryption at rest",
+				Destination: &cfg.VaultAddr,
+				Sources:     cli.EnvVars("VAULT_ADDR"),
+			},
+			&cli.StringFlag{
+				Name:        "vault-token",
+				Usage:       "Vault token with access to the transit key",
+				Category:    "Encryption at rest",
+				Destination: &cfg.VaultToken,
+				Sources:     cli.EnvVars("VAULT_TOKEN"),
+			},
+			&cli.StringFlag{
+				Name:        "vault-token-file",
+				Usage:       "Vault token file `path`, reloaded on SIGHUP",
+				Category:    "Encryption at rest",
+				Destination: &cfg.VaultTokenFile,
+				Sources:     cli.EnvVars("VAULT_TOKEN_FILE"),
+			},
+			&cli.StringFlag{
+				Name:        "vault-transit-mount",
+				Usage:       "Mount `path` of the Vault transit secrets engine",
+				Value:       defaults.VaultTransitMount,
+				Category:    "Encryption at rest",
+				Destination: &cfg.VaultTransitMount,
+				Sources:     cli.EnvVars("VAULT_TRANSIT_MOUNT"),
+			},
+			&cli.StringFlag{
+				Name:        "vault-transit-key",
+				Usage:       "Vault transit key `name`",
+				Value:       defaults.VaultTransitKey,
+				Category:    "Encryption at rest",
+				Destination: &cfg.VaultTransitKey,
+				Sources:     cli.EnvVars("VAULT_TRANSIT_KEY"),
+			},
 			&cli.StringFlag{
 				Name:        "log-level",
 				Usage:       "Log `severity` level, one of \"debug\", \"info\", \"warn\", or \"error\"",
@@ -235,27 +785,31 @@ func main() {
 func startService(ctx context.Context, _ *cli.Command) error {
 	showShutdown = true
 
-	if err := writePidFile(); err != nil {
+	if err := checkConfig(); err != nil {
 		return err
 	}
-	defer removePidFile()
+	if tlsCertFile != "" && tlsKeyFile != "" {
+		if err := serverCert.load(); err != nil {
+			return err
+		}
+	}
 
-	secrets, err := newSecretStore(ctx)
-	if err != nil {
+	if err := writePidFile(); err != nil {
 		return err
 	}
-	defer quiet.Close(secrets)
+	defer removePidFile()
 
-	limits, err := newLimiterStore()
+	srv, err := server.NewServer(cfg)
 	if err != nil {
 		return err
 	}
-	defer quiet.CloseWithTimeout(limits.Close, gracefulTimeout)
+	defer quiet.Close(srv)
 
-	server := &http.Server{
+	listener := &http.Server{
 		Addr:              listenAddr,
-		Handler:           newHandler(secrets, limits),
+		Handler:           srv,
 		ReadHeaderTimeout: time.Minute, // CWE-400 (slowloris) use nginx timeout
+		TLSConfig:         &tls.Config{GetCertificate: serverCert.getCertificate},
 	}
 
 	group, ctx := errgroup.NewContext(ctx)
@@ -263,14 +817,18 @@ func startService(ctx context.Context, _ *cli.Command) error {
 		ll := log.With("addr", listenAddr)
 		if tlsCertFile != "" && tlsKeyFile != "" {
 			ll.Info("Starting HTTPS listener")
-			return server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+			return listener.ListenAndServeTLS("", "")
 		}
 		ll.Info("Starting HTTP listener")
-		return server.ListenAndServe()
+		return listener.ListenAndServe()
 	})
 	group.Go(func() error {
 		<-ctx.Done()
-		quiet.CloseWithTimeout(server.Shutdown, gracefulTimeout)
+		quiet.CloseWithTimeout(listener.Shutdown, gracefulTimeout)
+		return nil
+	})
+	group.Go(func() error {
+		watchCredentialFiles(ctx, srv)
 		return nil
 	})
 	err = group.Wait()
@@ -280,6 +838,49 @@ func startService(ctx context.Context, _ *cli.Command) error {
 	return err
 }
 
+func rekeySecrets(ctx context.Context, _ *cli.Command) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	return server.Rekey(ctx, cfg)
+}
+
+func printStats(ctx context.Context, cmd *cli.Command) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	stats, err := server.ReadStats(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(cmd.Root().Writer)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
+
+func migrateDatabase(ctx context.Context, _ *cli.Command) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	return server.MigrateDatabase(ctx, cfg)
+}
+
+func databaseStatus(ctx context.Context, cmd *cli.Command) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	status, err := server.DatabaseStatus(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	w := cmd.Root().Writer
+	fmt.Fprintf(w, "Schema version %d of %d\n", status.Version, status.Latest)
+	for _, name := range status.Pending {
+		fmt.Fprintf(w, "Pending: %s\n", name)
+	}
+	return nil
+}
+
 func writePidFile() error {
 	if pidFilePath == skipPidFile {
 		return nil
@@ -303,6 +904,13 @@ func removePidFile() {
 	}
 }
 
+func setupConfig(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+	if err := loadConfigFile(cmd); err != nil {
+		return ctx, err
+	}
+	return setupLogging(ctx, cmd)
+}
+
 func setupLogging(ctx context.Context, _ *cli.Command) (context.Context, error) {
 	var level log.Level
 	switch logLevel {
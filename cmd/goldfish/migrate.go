@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+
+	"github.com/digitalocean-labs/goldfish/server"
+)
+
+var migrateFrom, migrateTo string
+
+func migrateSecrets(ctx context.Context, _ *cli.Command) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	from, err := migrateConfig(migrateFrom)
+	if err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := migrateConfig(migrateTo)
+	if err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+	return server.Migrate(ctx, from, to)
+}
+
+// migrateConfig applies a backend location to the configured options,
+// so that Redis TLS and encryption options are shared by both ends.
+func migrateConfig(location string) (server.Config, error) {
+	c := cfg
+	switch {
+	case strings.HasPrefix(location, "sqlite:"):
+		c.Backend = server.SqliteBackend
+		c.SqliteFile = strings.TrimPrefix(location, "sqlite:")
+		if c.SqliteFile == "" {
+			return c, fmt.Errorf("no database file in %q", location)
+		}
+	case strings.HasPrefix(location, "redis://"),
+		strings.HasPrefix(location, "rediss://"),
+		strings.HasPrefix(location, "unix://"):
+		c.Backend = server.RedisBackend
+		c.RedisURL = location
+		c.RedisURLFile = ""
+	default:
+		return c, fmt.Errorf("%q must be sqlite:path, or a redis://, rediss://, or unix:// url", location)
+	}
+	return c, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/digitalocean-labs/goldfish/server"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	cfg = server.DefaultConfig()
+	cfg.RedisTLS = server.RedisTLSOn
+	defer func() { cfg = server.Config{} }()
+
+	from, err := migrateConfig("sqlite:/var/lib/goldfish.db")
+	assert.NilError(t, err)
+	assert.Equal(t, server.SqliteBackend, from.Backend)
+	assert.Equal(t, "/var/lib/goldfish.db", from.SqliteFile)
+
+	to, err := migrateConfig("rediss://redis.internal:6379/0?ns=goldfish")
+	assert.NilError(t, err)
+	assert.Equal(t, server.RedisBackend, to.Backend)
+	assert.Equal(t, "rediss://redis.internal:6379/0?ns=goldfish", to.RedisURL)
+	assert.Equal(t, server.RedisTLSOn, to.RedisTLS)
+
+	_, err = migrateConfig("sqlite:")
+	assert.ErrorContains(t, err, "no database file")
+	_, err = migrateConfig("mongodb://localhost")
+	assert.ErrorContains(t, err, "must be sqlite:path")
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditCreated = "created"
+	auditViewed  = "viewed"
+	auditExpired = "expired"
+	auditBurned  = "burned"
+	auditRefused = "refused"
+)
+
+// auditEvent records a secret lifecycle event. It must never carry
+// secret values, and only carries secret keys and client IP addresses
+// as the keyed hashes that are added when it is recorded.
+type auditEvent struct {
+	Event    string    `json:"event"`
+	KeyHash  string    `json:"key_hash"`
+	Time     time.Time `json:"time"`
+	ExpireAt time.Time `json:"expire_at,omitzero"`
+	TTL      int64     `json:"ttl_seconds,omitempty"`
+	Creator  string    `json:"creator,omitempty"`
+	ViewerIP string    `json:"viewer_ip_hash,omitempty"`
+
+	secretKey string
+	clientIP  string
+}
+
+func newAuditEvent(event, key string) *auditEvent {
+	return &auditEvent{
+		Event:     event,
+		Time:      time.Now().UTC(),
+		secretKey: key,
+	}
+}
+
+type auditSink interface {
+	write(line []byte) error
+	io.Closer
+}
+
+// auditLog fans out lifecycle events to all configured sinks.
+// A nil auditLog is valid and discards all events.
+type auditLog struct {
+	cfg   *config
+	sinks []auditSink
+	// key is used when AuditHashKey is not set
+	key []byte
+}
+
+func (c *config) newAuditLog() (*auditLog, error) {
+	var sinks []auditSink
+	if c.AuditFile != "" {
+		log.Info("Writing audit events to file", "path", c.AuditFile)
+		sink, err := newAuditFileSink(c.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if c.AuditSyslog != "" {
+		log.Info("Writing audit events to syslog", "addr", c.AuditSyslog)
+		sink, err := newAuditSyslogSink(c.AuditSyslog)
+		if err != nil {
+			closeAuditSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if c.AuditWebhook != "" {
+		log.Info("Sending audit events to webhook")
+		sink, err := newAuditWebhookSink(c.AuditWebhook)
+		if err != nil {
+			closeAuditSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	a := &auditLog{cfg: c, sinks: sinks}
+	if c.AuditHashKey == "" && c.AuditHashKeyFile == "" {
+		log.Warn("Audit hashes use a random key, and will not match those from before a restart, without an audit hash key")
+		a.key = make([]byte, sha256.Size)
+		_, _ = rand.Read(a.key)
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(event *auditEvent) {
+	if a == nil {
+		return
+	}
+	event.KeyHash = a.hash(event.secretKey)
+	if event.clientIP != "" {
+		event.ViewerIP = a.hash(event.clientIP)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Warn("audit encode failed", "err", err)
+		return
+	}
+	for _, sink := range a.sinks {
+		if err = sink.write(line); err != nil {
+			log.Warn("audit write failed", "event", event.Event, "err", err)
+		}
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	closeAuditSinks(a.sinks)
+	return nil
+}
+
+func closeAuditSinks(sinks []auditSink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Warn("audit close failed", "err", err)
+		}
+	}
+}
+
+func hashValue(value string) string {
+	data := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("%x", data)
+}
+
+// hash is keyed, since client IP addresses, unlike secret keys,
+// are few enough that all of their plain hashes can be computed.
+func (a *auditLog) hash(value string) string {
+	key := a.key
+	if a.cfg != nil {
+		if configured := a.cfg.credential(&a.cfg.AuditHashKey); configured != "" {
+			key = []byte(configured)
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// JSON-lines file sink
+
+type auditFileSink struct {
+	mu sync.Mutex
+	fp *os.File
+}
+
+func newAuditFileSink(path string) (auditSink, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFileSink{fp: fp}, nil
+}
+
+func (s *auditFileSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := make([]byte, 0, len(line)+1)
+	buf = append(buf, line...)
+	buf = append(buf, '\n')
+	_, err := s.fp.Write(buf)
+	return err
+}
+
+func (s *auditFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fp.Close()
+}
+
+// syslog sink
+
+type auditSyslogSink struct {
+	w *syslog.Writer
+}
+
+// newAuditSyslogSink accepts either "local" for the local syslog
+// daemon, or a "udp://host:port" or "tcp://host:port" address.
+func newAuditSyslogSink(addr string) (auditSink, error) {
+	const priority = syslog.LOG_INFO | syslog.LOG_AUTH
+	if addr == AuditSyslogLocal {
+		w, err := syslog.New(priority, "goldfish")
+		if err != nil {
+			return nil, err
+		}
+		return &auditSyslogSink{w}, nil
+	}
+	parsed, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad syslog address: %w", err)
+	}
+	if parsed.Scheme != "udp" && parsed.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog network %q", parsed.Scheme)
+	}
+	w, err := syslog.Dial(parsed.Scheme, parsed.Host, priority, "goldfish")
+	if err != nil {
+		return nil, err
+	}
+	return &auditSyslogSink{w}, nil
+}
+
+func (s *auditSyslogSink) write(line []byte) error {
+	return s.w.Info(string(line))
+}
+
+func (s *auditSyslogSink) Close() error {
+	return s.w.Close()
+}
+
+// webhook sink
+
+const (
+	auditWebhookQueue   = 100
+	auditWebhookTimeout = 5 * time.Second
+)
+
+// auditWebhookSink posts events from a background worker
+// so that slow receivers do not hold up secret requests.
+type auditWebhookSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAuditWebhookSink(target string) (auditSink, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("bad audit webhook: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, errors.New("audit webhook must be an http or https url")
+	}
+	s := &auditWebhookSink{
+		url:    target,
+		client: &http.Client{Timeout: auditWebhookTimeout},
+		queue:  make(chan []byte, auditWebhookQueue),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *auditWebhookSink) write(line []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("audit webhook is closed")
+	}
+	select {
+	case s.queue <- line:
+		return nil
+	default:
+		return errors.New("audit webhook queue is full")
+	}
+}
+
+func (s *auditWebhookSink) run() {
+	defer close(s.done)
+	for line := range s.queue {
+		if err := s.post(line); err != nil {
+			log.Warn("audit webhook failed", "err", err)
+		}
+	}
+}
+
+func (s *auditWebhookSink) post(line []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), auditWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %q", res.Status)
+	}
+	return nil
+}
+
+func (s *auditWebhookSink) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAuditExpireSecrets(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := newAuditFileSink(path)
+	assert.NilError(t, err)
+	audit := &auditLog{sinks: []auditSink{sink}}
+
+	ctx := context.Background()
+	store := sqliteStore{db: db, now: clock, audit: audit}
+	defer store.Close()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+	})
+	assert.NilError(t, err)
+
+	store.expireSecrets(ctx, now.Add(2*time.Hour))
+	assert.NilError(t, audit.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(data), key))
+	assert.Assert(t, !strings.Contains(string(data), "wibble"))
+
+	var event auditEvent
+	assert.NilError(t, json.Unmarshal(data, &event))
+	assert.Equal(t, auditExpired, event.Event)
+	assert.Equal(t, audit.hash(key), event.KeyHash)
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	sink, err := newAuditWebhookSink(server.URL)
+	assert.NilError(t, err)
+	audit := &auditLog{sinks: []auditSink{sink}}
+
+	audit.record(newAuditEvent(auditViewed, "wibble"))
+	assert.NilError(t, audit.Close())
+
+	body := <-received
+	assert.Assert(t, strings.Contains(body, audit.hash("wibble")))
+	assert.Assert(t, !strings.Contains(body, `"wibble"`))
+}
+
+func TestAuditHash(t *testing.T) {
+	c := testConfig()
+	c.AuditFile = filepath.Join(t.TempDir(), "audit.jsonl")
+	c.AuditHashKey = "wibble"
+	audit, err := c.newAuditLog()
+	assert.NilError(t, err)
+	defer audit.Close()
+
+	// client IP addresses cannot be found from unkeyed hashes
+	assert.Assert(t, audit.hash("192.0.2.1") != hashValue("192.0.2.1"))
+	assert.Equal(t, audit.hash("192.0.2.1"), audit.hash("192.0.2.1"))
+
+	// nor from the hashes of a server without a configured key
+	other := testConfig()
+	other.AuditFile = c.AuditFile
+	random, err := other.newAuditLog()
+	assert.NilError(t, err)
+	defer random.Close()
+	assert.Assert(t, random.hash("192.0.2.1") != audit.hash("192.0.2.1"))
+	assert.Assert(t, random.hash("192.0.2.1") != hashValue("192.0.2.1"))
+}
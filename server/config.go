@@ -0,0 +1,259 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SqliteBackend = "sqlite"
+	RedisBackend  = "redis"
+	MemoryBackend = "memory"
+	EtcdBackend   = "etcd"
+
+	RedisTLSOn       = "on"
+	RedisTLSOff      = "off"
+	RedisTLSInsecure = "insecure"
+
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+
+	FileKeyProvider  = "file"
+	VaultKeyProvider = "vault"
+
+	AuditSyslogLocal = "local"
+)
+
+// Config holds the options of a Server. Start from DefaultConfig,
+// since the zero value of some options cannot be used.
+type Config struct {
+	// BreakerRatio is the circuit-breaker failure ratio;
+	// zero or less disables the circuit-breaker.
+	BreakerRatio float64
+
+	// Backend is SqliteBackend, RedisBackend, MemoryBackend,
+	// EtcdBackend, or the name of a backend from RegisterStore.
+	Backend string
+
+	SqliteFile  string
+	SqliteClean time.Duration
+	// SqliteJournalMode and SqliteSynchronous are
+	// values of the SQLite pragmas of the same name.
+	SqliteJournalMode  string
+	SqliteSynchronous  string
+	SqliteBusyTimeout  time.Duration
+	SqliteMaxOpenConns int
+	SqliteMaxIdleConns int
+
+	// MemoryMaxBytes limits the size of all secret values
+	// in the memory backend; zero or less for no limit.
+	MemoryMaxBytes int
+	MemoryClean    time.Duration
+
+	// RedisURL, when set, replaces the address, credential,
+	// db, namespace, and TLS options of the Redis backend.
+	RedisURL            string
+	RedisURLFile        string
+	RedisAddr           string
+	RedisMode           string
+	RedisSentinelMaster string
+	RedisUser           string
+	RedisPass           string
+	RedisPassFile       string
+	RedisDB             int
+	RedisNS             string
+	RedisTLS            string
+	RedisCAFile         string
+	RedisCertFile       string
+	RedisKeyFile        string
+	RedisServerName     string
+
+	RedisMaxIdle        int
+	RedisMaxActive      int
+	RedisWait           bool
+	RedisIdleTimeout    time.Duration
+	RedisConnectTimeout time.Duration
+	RedisReadTimeout    time.Duration
+	RedisWriteTimeout   time.Duration
+
+	// EtcdEndpoints is a comma-separated list of etcd client URLs,
+	// and EtcdNS is a key prefix like the RedisNS namespace.
+	EtcdEndpoints   string
+	EtcdNS          string
+	EtcdUser        string
+	EtcdPass        string
+	EtcdPassFile    string
+	EtcdCAFile      string
+	EtcdCertFile    string
+	EtcdKeyFile     string
+	EtcdDialTimeout time.Duration
+
+	// S3Bucket, when set, keeps secret values of at least S3MinBytes
+	// as objects in an S3-compatible bucket, and allows secret values
+	// of up to S3MaxBytes. S3Sweep is the interval for removal of the
+	// objects of secrets that were not taken before they expired.
+	S3Bucket        string
+	S3Endpoint      string
+	S3Region        string
+	S3Prefix        string
+	S3AccessKey     string
+	S3SecretKey     string
+	S3SecretKeyFile string
+	S3MinBytes      int
+	S3MaxBytes      int
+	S3Sweep         time.Duration
+
+	// LimitCount is the number of requests allowed per client IP
+	// in each LimitPeriod; zero disables the rate-limiter.
+	LimitCount  uint64
+	LimitPeriod time.Duration
+	// LimitHeaders is a comma-separated list of request
+	// headers that can provide the client IP address.
+	LimitHeaders string
+
+	// AllowedCIDRs is a comma-separated list of the networks that
+	// senders can restrict the retrieval of their secrets to, which
+	// is checked against the same client IP as the rate-limiter.
+	AllowedCIDRs string
+
+	// AdminToken enables the admin endpoints for requests
+	// with an "Authorization: Bearer" header of this token.
+	AdminToken     string
+	AdminTokenFile string
+
+	AuditFile       string
+	AuditSyslog     string
+	AuditWebhook    string
+	AuditUserHeader string
+	// AuditHashKey keys the hashes of secret keys and client IP
+	// addresses in audit events; a random key is used if it is not set.
+	AuditHashKey     string
+	AuditHashKeyFile string
+
+	NotifyWebhooks bool
+	// NotifyMailDomains is a comma-separated list of the domains, or
+	// addresses, that email notifications can be sent to, since anyone
+	// who can create a secret can choose where its notifications go.
+	NotifyMailDomains  string
+	NotifySmtpAddr     string
+	NotifySmtpFrom     string
+	NotifySmtpUser     string
+	NotifySmtpPass     string
+	NotifySmtpPassFile string
+	NotifyPoll         time.Duration
+
+	// KeyProvider is either FileKeyProvider or VaultKeyProvider.
+	KeyProvider        string
+	EncryptionKeys     string
+	EncryptionKeysFile string
+	VaultAddr          string
+	VaultToken         string
+	VaultTokenFile     string
+	VaultTransitMount  string
+	VaultTransitKey    string
+}
+
+// DefaultConfig returns the same defaults as the goldfish command.
+func DefaultConfig() Config {
+	return Config{
+		BreakerRatio:        0.1,
+		Backend:             SqliteBackend,
+		SqliteFile:          "goldfish.db",
+		SqliteClean:         time.Hour,
+		SqliteJournalMode:   "wal",
+		SqliteSynchronous:   "full",
+		SqliteBusyTimeout:   5 * time.Second,
+		SqliteMaxIdleConns:  2,
+		MemoryMaxBytes:      64 << 20,
+		MemoryClean:         time.Minute,
+		RedisAddr:           "localhost:6379",
+		RedisMode:           RedisModeStandalone,
+		RedisSentinelMaster: "mymaster",
+		RedisTLS:            RedisTLSOff,
+		RedisMaxIdle:        3,
+		RedisIdleTimeout:    2 * time.Minute,
+		RedisConnectTimeout: 5 * time.Second,
+		RedisReadTimeout:    5 * time.Second,
+		RedisWriteTimeout:   5 * time.Second,
+		EtcdEndpoints:       "http://localhost:2379",
+		EtcdDialTimeout:     5 * time.Second,
+		S3Endpoint:          "https://s3.amazonaws.com",
+		S3Prefix:            "goldfish/",
+		S3MinBytes:          4096,
+		S3MaxBytes:          8 << 20,
+		S3Sweep:             time.Hour,
+		LimitCount:          1000,
+		LimitPeriod:         time.Hour,
+		NotifySmtpFrom:      "goldfish@localhost",
+		NotifyPoll:          time.Minute,
+		KeyProvider:         FileKeyProvider,
+		VaultTransitMount:   "transit",
+		VaultTransitKey:     "goldfish",
+	}
+}
+
+// Validate reports option values that would otherwise only fail when first used.
+func (cfg Config) Validate() error {
+	var problems []error
+	check := func(name, value string, allowed ...string) {
+		if !slices.Contains(allowed, value) {
+			problems = append(problems, fmt.Errorf("invalid %s %q, must be one of %q", name, value, allowed))
+		}
+	}
+	check("backend", cfg.Backend, StoreNames()...)
+	check("sqlite-journal-mode", strings.ToLower(cfg.SqliteJournalMode), "delete", "truncate", "persist", "memory", "wal", "off")
+	check("sqlite-synchronous", strings.ToLower(cfg.SqliteSynchronous), "off", "normal", "full", "extra")
+	check("redis-tls", cfg.RedisTLS, RedisTLSOff, RedisTLSOn, RedisTLSInsecure)
+	check("redis-mode", cfg.RedisMode, RedisModeStandalone, RedisModeSentinel, RedisModeCluster)
+	check("key-provider", cfg.KeyProvider, FileKeyProvider, VaultKeyProvider)
+	if cfg.RedisURL != "" {
+		if _, err := parseRedisURL(cfg.RedisURL); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if _, err := parseCIDRs(cfg.AllowedCIDRs); err != nil {
+		problems = append(problems, fmt.Errorf("invalid allowed-cidrs: %w", err))
+	}
+	if cfg.NotifySmtpAddr != "" && cfg.NotifyMailDomains == "" {
+		problems = append(problems, errors.New("notify-smtp-addr requires notify-mail-domains"))
+	}
+	return errors.Join(problems...)
+}
+
+// config is the copy of a Config that belongs to one Server,
+// along with the settings that are derived from its options.
+type config struct {
+	Config
+
+	// Credentials can be reloaded while connections are being made,
+	// so they must be read with credential() once the server runs.
+	credentialsMu sync.RWMutex
+
+	// redisNet is set from the scheme of a redis url
+	redisNet string
+}
+
+func newConfig(cfg Config) *config {
+	return &config{Config: cfg}
+}
+
+// loadConfig reads the credential files of a config and resolves its Redis
+// url once, before anything connects, so that the options that the url
+// replaces are not set again while credentials may be reloaded.
+func loadConfig(cfg Config) (*config, error) {
+	c := newConfig(cfg)
+	if err := c.loadCredentialFiles(); err != nil {
+		return nil, err
+	}
+	if c.RedisURL != "" {
+		if err := c.applyRedisURL(c.RedisURL); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	log "log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// credentialFile reads a sensitive option from a file, such as a Docker
+// or Kubernetes secret, so that it does not appear in process listings
+// or in the environment of the process.
+type credentialFile struct {
+	name  string
+	path  *string
+	value *string
+	apply func(value string) error
+}
+
+func (c *config) credentialFiles() []credentialFile {
+	return []credentialFile{
+		{name: "redis-pass", path: &c.RedisPassFile, value: &c.RedisPass},
+		{name: "redis-url", path: &c.RedisURLFile, value: &c.RedisURL, apply: c.applyRedisURLCredentials},
+		{name: "notify-smtp-pass", path: &c.NotifySmtpPassFile, value: &c.NotifySmtpPass},
+		{name: "vault-token", path: &c.VaultTokenFile, value: &c.VaultToken},
+		{name: "admin-token", path: &c.AdminTokenFile, value: &c.AdminToken},
+		{name: "s3-secret-key", path: &c.S3SecretKeyFile, value: &c.S3SecretKey},
+		{name: "etcd-pass", path: &c.EtcdPassFile, value: &c.EtcdPass},
+		{name: "audit-hash-key", path: &c.AuditHashKeyFile, value: &c.AuditHashKey},
+	}
+}
+
+func (c *config) credential(value *string) string {
+	c.credentialsMu.RLock()
+	defer c.credentialsMu.RUnlock()
+	return *value
+}
+
+// loadCredentialFiles reads all configured credential files at startup,
+// before any connections are made.
+func (c *config) loadCredentialFiles() error {
+	for _, cf := range c.credentialFiles() {
+		if *cf.path == "" {
+			continue
+		}
+		if *cf.value != "" {
+			return fmt.Errorf("%s and %s-file cannot both be set", cf.name, cf.name)
+		}
+		value, err := readCredentialFile(*cf.path)
+		if err != nil {
+			return err
+		}
+		*cf.value = value
+	}
+	return nil
+}
+
+// reloadCredentialFiles keeps the current value of any
+// credential whose file cannot be read or applied.
+func (c *config) reloadCredentialFiles() {
+	for _, cf := range c.credentialFiles() {
+		if *cf.path == "" {
+			continue
+		}
+		value, err := readCredentialFile(*cf.path)
+		if err != nil {
+			log.Warn("Failed to reload credential", "option", cf.name, "err", err)
+			continue
+		}
+		c.credentialsMu.Lock()
+		if cf.apply != nil {
+			err = cf.apply(value)
+		}
+		if err == nil {
+			*cf.value = value
+		}
+		c.credentialsMu.Unlock()
+		if err != nil {
+			log.Warn("Failed to reload credential", "option", cf.name, "err", err)
+			continue
+		}
+		log.Info("Reloaded credential", "option", cf.name)
+	}
+}
+
+func readCredentialFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// applyRedisURLCredentials only takes the credentials from a reloaded url,
+// since existing keys and connections depend on everything else.
+func (c *config) applyRedisURLCredentials(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid redis url: %w", err)
+	}
+	c.RedisUser, c.RedisPass = redisURLCredentials(u)
+	return nil
+}
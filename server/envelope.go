@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sealed values have the form "gf2:<key id>:<wrapped data key>:<ciphertext>"
+// so that they can be told apart from values stored before encryption at rest
+// was enabled, and so that rotated keys can still open older values. Their
+// ciphertext is bound to the hash of their secret key, so that they cannot
+// be opened under another key. Values sealed before that have a "gf1:" prefix,
+// as do payload objects that were not named after the hash of their key.
+const (
+	sealedPrefix       = "gf2:"
+	legacySealedPrefix = "gf1:"
+)
+
+// KeyProvider wraps and unwraps the data keys of stored secrets with
+// a server key-encryption key, so that the key-encryption key itself
+// can be kept in an external key management service.
+type KeyProvider interface {
+	// KeyID identifies the key-encryption key that wraps new data keys.
+	KeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+func (c *config) newKeyProvider() (KeyProvider, error) {
+	switch c.KeyProvider {
+	case FileKeyProvider:
+		return c.newFileKeyProvider()
+	case VaultKeyProvider:
+		return c.newVaultKeyProvider()
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", c.KeyProvider)
+	}
+}
+
+// checkKeyProvider makes sure that we fail closed at startup,
+// rather than when the first secret arrives, when a provider
+// cannot wrap and unwrap keys.
+func checkKeyProvider(ctx context.Context, keys KeyProvider) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	wrapped, err := keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return fmt.Errorf("key provider check failed: %w", err)
+	}
+	unwrapped, err := keys.UnwrapKey(ctx, keys.KeyID(), wrapped)
+	if err != nil {
+		return fmt.Errorf("key provider check failed: %w", err)
+	}
+	if !bytes.Equal(dataKey, unwrapped) {
+		return errors.New("key provider check failed: unwrapped key does not match")
+	}
+	return nil
+}
+
+// sealPrefix is the prefix of values that are sealed with the
+// hash of their secret key, which is empty if it is not known.
+func sealPrefix(keyHash string) string {
+	if keyHash == "" {
+		return legacySealedPrefix
+	}
+	return sealedPrefix
+}
+
+func sealValue(ctx context.Context, keys KeyProvider, plain, keyHash string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", err
+	}
+	// read after wrapping, since the vault provider
+	// learns of a rotated transit key by wrapping
+	keyID := keys.KeyID()
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := aeadSeal(aead, []byte(plain), []byte(keyHash))
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return sealPrefix(keyHash) + keyID + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(sealed), nil
+}
+
+func openValue(ctx context.Context, keys KeyProvider, value, keyHash string) (string, error) {
+	body, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		if body, ok = strings.CutPrefix(value, legacySealedPrefix); !ok {
+			return value, nil // stored before encryption at rest
+		}
+		keyHash = ""
+	}
+	parts := strings.Split(body, ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed sealed secret")
+	}
+	enc := base64.RawURLEncoding
+	wrapped, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	sealed, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := keys.UnwrapKey(ctx, parts[0], wrapped)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := aeadOpen(aead, sealed, []byte(keyHash))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// needsRekey reports values that are either not sealed, have
+// not been sealed with the current key, or have not been bound to
+// the hash of their secret key. Payload references are not sealed,
+// since their objects are, and those are rekeyed by rekeyPayloads.
+func needsRekey(keys KeyProvider, value, keyHash string) bool {
+	if strings.HasPrefix(value, payloadPrefix) {
+		return false
+	}
+	return !strings.HasPrefix(value, sealPrefix(keyHash)+keys.KeyID()+":")
+}
+
+func resealValue(ctx context.Context, keys KeyProvider, value, keyHash string) (string, error) {
+	plain, err := openValue(ctx, keys, value, keyHash)
+	if err != nil {
+		return "", err
+	}
+	return sealValue(ctx, keys, plain, keyHash)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func aeadSeal(aead cipher.AEAD, plain, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, data), nil
+}
+
+func aeadOpen(aead cipher.AEAD, sealed, data []byte) ([]byte, error) {
+	size := aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("malformed sealed secret")
+	}
+	return aead.Open(nil, sealed[:size], sealed[size:], data)
+}
+
+// sealedStore encrypts secret values before they reach
+// the backend, and decrypts them on their way out. It chooses
+// the key of each secret, so that its value can be bound to it.
+type sealedStore struct {
+	Store
+	keys KeyProvider
+}
+
+func (s *sealedStore) Put(ctx context.Context, req *SecretWithTTL) (string, error) {
+	clone := *req
+	clone.Key = NewSecretKey()
+	sealed, err := sealValue(ctx, s.keys, req.Secret, hashValue(clone.Key))
+	if err != nil {
+		return "", err
+	}
+	clone.Secret = sealed
+	key, err := s.Store.Put(ctx, &clone)
+	if err == nil && key != clone.Key {
+		return "", errors.New("backend did not store an encrypted secret under its key")
+	}
+	return key, err
+}
+
+func (s *sealedStore) Take(ctx context.Context, key string) (string, error) {
+	value, err := s.Store.Take(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return openValue(ctx, s.keys, value, hashValue(key))
+}
+
+// rekeyStore is implemented by backends that can
+// re-encrypt their stored secrets in place.
+type rekeyStore interface {
+	rekey(ctx context.Context, keys KeyProvider) (count int, err error)
+}
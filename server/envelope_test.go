@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"gotest.tools/v3/assert"
+)
+
+func testKeyEntry(id string) string {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return id + "=" + base64.StdEncoding.EncodeToString(key)
+}
+
+func TestFileKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	first := testKeyEntry("first")
+	second := testKeyEntry("second")
+
+	keyHash := hashValue(NewSecretKey())
+
+	oldRing, err := parseFileKeys([]string{first})
+	assert.NilError(t, err)
+
+	sealed, err := sealValue(ctx, oldRing, "wibble", keyHash)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(sealed, "gf2:first:"))
+	assert.Assert(t, !strings.Contains(sealed, "wibble"))
+
+	newRing, err := parseFileKeys([]string{second, first})
+	assert.NilError(t, err)
+	assert.Assert(t, needsRekey(newRing, sealed, keyHash))
+	assert.Assert(t, needsRekey(newRing, "unsealed", keyHash))
+
+	plain, err := openValue(ctx, newRing, sealed, keyHash)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", plain)
+
+	resealed, err := resealValue(ctx, newRing, sealed, keyHash)
+	assert.NilError(t, err)
+	assert.Assert(t, !needsRekey(newRing, resealed, keyHash))
+
+	_, err = openValue(ctx, oldRing, resealed, keyHash)
+	assert.ErrorContains(t, err, `unknown encryption key "second"`)
+}
+
+func TestSealedKeyBinding(t *testing.T) {
+	ctx := context.Background()
+	keys, err := parseFileKeys([]string{testKeyEntry("k1")})
+	assert.NilError(t, err)
+	keyHash := hashValue(NewSecretKey())
+
+	// values cannot be opened under another secret key
+	sealed, err := sealValue(ctx, keys, "wibble", keyHash)
+	assert.NilError(t, err)
+	_, err = openValue(ctx, keys, sealed, hashValue(NewSecretKey()))
+	assert.ErrorContains(t, err, "message authentication failed")
+
+	// values sealed before they were bound to their keys can still be opened
+	legacy, err := sealValue(ctx, keys, "wibble", "")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(legacy, "gf1:k1:"))
+	plain, err := openValue(ctx, keys, legacy, keyHash)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", plain)
+	assert.Assert(t, needsRekey(keys, legacy, keyHash))
+	assert.Assert(t, !needsRekey(keys, legacy, ""))
+
+	resealed, err := resealValue(ctx, keys, legacy, keyHash)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(resealed, "gf2:k1:"))
+}
+
+func TestSealedStoreKeys(t *testing.T) {
+	ctx := context.Background()
+	keys, err := parseFileKeys([]string{testKeyEntry("k1")})
+	assert.NilError(t, err)
+	backend, _ := testMemoryStore(t, 0)
+	store := &sealedStore{Store: backend, keys: keys}
+
+	first, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	second, err := store.Put(ctx, &SecretWithTTL{Secret: "wobble", TTL: time.Hour})
+	assert.NilError(t, err)
+
+	// a value that is moved to another key cannot be taken with it
+	copy(backend.secrets[second].value, backend.secrets[first].value)
+	_, err = store.Take(ctx, second)
+	assert.ErrorContains(t, err, "message authentication failed")
+
+	secret, err := store.Take(ctx, first)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
+
+func TestParseFileKeys_Invalid(t *testing.T) {
+	_, err := parseFileKeys([]string{"nokey"})
+	assert.ErrorContains(t, err, "id=base64key")
+
+	_, err = parseFileKeys([]string{"short=" + base64.StdEncoding.EncodeToString([]byte("short"))})
+	assert.ErrorContains(t, err, "32 bytes")
+
+	entry := testKeyEntry("dup")
+	_, err = parseFileKeys([]string{entry, entry})
+	assert.ErrorContains(t, err, "duplicate")
+
+	ring, err := parseFileKeys([]string{"", "# comment"})
+	assert.NilError(t, err)
+	assert.Assert(t, ring == nil)
+}
+
+func TestSqliteRekey(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	ctx := context.Background()
+	backend := &sqliteStore{db: db, now: time.Now}
+	defer backend.Close()
+
+	// stored before encryption at rest was enabled
+	key, err := backend.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+	})
+	assert.NilError(t, err)
+
+	keys, err := parseFileKeys([]string{testKeyEntry("k1")})
+	assert.NilError(t, err)
+
+	count, err := backend.rekey(ctx, keys)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, count)
+
+	var stored string
+	err = db.QueryRow("SELECT secret_value FROM secrets WHERE secret_key = ?", key).Scan(&stored)
+	assert.NilError(t, err)
+	assert.Assert(t, !needsRekey(keys, stored, hashValue(key)))
+
+	store := &sealedStore{Store: backend, keys: keys}
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
+
+func TestRedisRekey(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NilError(t, err)
+	defer mr.Close()
+
+	pool := &redis.Pool{
+		MaxIdle:      3,
+		IdleTimeout:  time.Minute,
+		Dial:         func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) },
+		TestOnBorrow: redisTestFunc,
+	}
+
+	ctx := context.Background()
+	oldEntry := testKeyEntry("old")
+	oldKeys, err := parseFileKeys([]string{oldEntry})
+	assert.NilError(t, err)
+	c := testConfig()
+	store := &sealedStore{Store: &redisStore{cfg: c, db: pool, now: time.Now}, keys: oldKeys}
+	defer store.Close()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+	})
+	assert.NilError(t, err)
+
+	newKeys, err := parseFileKeys([]string{testKeyEntry("new"), oldEntry})
+	assert.NilError(t, err)
+
+	count, err := store.Store.(rekeyStore).rekey(ctx, newKeys)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, count)
+
+	stored, err := mr.Get(c.redisKey("s", key))
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(stored, "gf2:new:"))
+	assert.Equal(t, time.Hour, mr.TTL(c.redisKey("s", key)))
+
+	store.keys = newKeys
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
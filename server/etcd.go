@@ -0,0 +1,602 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomcz/gotools/quiet"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	etcdExpiryBatch    = 1000
+	etcdReconnectDelay = time.Minute
+)
+
+var errEtcdNoEndpoints = errors.New("etcd backend needs at least one endpoint")
+
+// etcdStore keeps each secret under a lease of its TTL, so that etcd
+// removes it on expiry. Its receipt, notification target, and expiry
+// index entry share a second lease that lasts for statusRetention
+// beyond the TTL, like the notification grace period of Redis.
+//
+// Expiry index keys embed the zero-padded expiry time, so that a range
+// read finds the secrets that expired unread in the order of expiry.
+type etcdStore struct {
+	cfg    *config
+	now    func() time.Time
+	audit  *auditLog
+	notify *notifier
+
+	// db is replaced when the password changes, since
+	// a client only ever uses the password it was given
+	mu      sync.Mutex
+	db      *clientv3.Client
+	pass    string
+	retryAt time.Time
+}
+
+// etcdReceipt is the stored form of a management receipt.
+type etcdReceipt struct {
+	Key      string `json:"key"`
+	State    string `json:"state"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+func (c *config) newEtcdStore(ctx context.Context, audit *auditLog, notify *notifier) (Store, error) {
+	client, err := c.newEtcdClient()
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Using etcd secret store", "endpoints", c.EtcdEndpoints)
+	store := &etcdStore{
+		cfg:    c,
+		db:     client,
+		pass:   c.credential(&c.EtcdPass),
+		now:    time.Now,
+		audit:  audit,
+		notify: notify,
+	}
+	go store.regularExpiryPolling(ctx)
+	return store, nil
+}
+
+func (c *config) newEtcdClient() (*clientv3.Client, error) {
+	endpoints := c.etcdEndpoints()
+	if len(endpoints) == 0 {
+		return nil, errEtcdNoEndpoints
+	}
+	tlsConfig, err := c.etcdTLS()
+	if err != nil {
+		return nil, err
+	}
+	return clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		Username:    c.EtcdUser,
+		Password:    c.credential(&c.EtcdPass),
+		DialTimeout: c.EtcdDialTimeout,
+		TLS:         tlsConfig,
+		// errors are returned to us, and logged as we see fit
+		Logger: zap.NewNop(),
+	})
+}
+
+func (c *config) etcdEndpoints() []string {
+	var endpoints []string
+	for endpoint := range strings.SplitSeq(c.EtcdEndpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+func (c *config) etcdTLS() (*tls.Config, error) {
+	if c.EtcdCAFile == "" && c.EtcdCertFile == "" && c.EtcdKeyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.EtcdCAFile != "" {
+		pem, err := os.ReadFile(c.EtcdCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.EtcdCAFile)
+		}
+	}
+	if c.EtcdCertFile != "" || c.EtcdKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.EtcdCertFile, c.EtcdKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// etcdKey has the same namespace semantics as redisKey,
+// with the "/" separator that etcd tools expect.
+func (c *config) etcdKey(prefix, key string) string {
+	if c.EtcdNS != "" {
+		return fmt.Sprintf("%s/%s/%s", c.EtcdNS, prefix, key)
+	}
+	return fmt.Sprintf("%s/%s", prefix, key)
+}
+
+func (c *config) etcdExpiryKey(expireAt int64, secretKey string) string {
+	return c.etcdKey("x", fmt.Sprintf("%020d/%s", expireAt, secretKey))
+}
+
+func (r *etcdStore) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.db.Close()
+}
+
+// client connects again with a reloaded password, and closes the
+// previous client once the requests that are using it have finished.
+// Failed connections are retried after a delay, rather than on every
+// request, since each attempt can take up to the dial timeout.
+func (r *etcdStore) client() *clientv3.Client {
+	pass := r.cfg.credential(&r.cfg.EtcdPass)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pass == r.pass || time.Now().Before(r.retryAt) {
+		return r.db
+	}
+	db, err := r.cfg.newEtcdClient()
+	if err != nil {
+		log.Warn("Failed to reconnect to etcd", "err", err)
+		r.retryAt = time.Now().Add(etcdReconnectDelay)
+		return r.db
+	}
+	previous := r.db
+	time.AfterFunc(etcdReconnectDelay, func() { quiet.Close(previous) })
+	r.db, r.pass = db, pass
+	return db
+}
+
+func (r *etcdStore) Put(ctx context.Context, req *SecretWithTTL) (string, error) {
+	secretKey := req.newKey()
+	ttl := int64(req.TTL.Seconds())
+	expireAt := r.now().Add(req.TTL).Unix()
+
+	secretLease, err := r.client().Grant(ctx, ttl)
+	if err != nil {
+		return "", err
+	}
+	retainLease, err := r.client().Grant(ctx, ttl+int64(statusRetention.Seconds()))
+	if err != nil {
+		r.revokeLeases(ctx, int64(secretLease.ID))
+		return "", err
+	}
+	expireValue := strconv.FormatInt(expireAt, 10)
+	ops := []clientv3.Op{
+		clientv3.OpPut(r.cfg.etcdKey("s", secretKey), req.Secret, clientv3.WithLease(secretLease.ID)),
+		clientv3.OpPut(r.cfg.etcdKey("e", secretKey), expireValue, clientv3.WithLease(retainLease.ID)),
+		// the expiry index lets us detect secrets that expired unread
+		clientv3.OpPut(r.cfg.etcdExpiryKey(expireAt, secretKey), "", clientv3.WithLease(retainLease.ID)),
+	}
+	if req.Notify != "" {
+		ops = append(ops, clientv3.OpPut(r.cfg.etcdKey("n", secretKey), req.Notify, clientv3.WithLease(retainLease.ID)))
+	}
+	if !req.NotBefore.IsZero() {
+		notBefore := strconv.FormatInt(req.NotBefore.Unix(), 10)
+		ops = append(ops, clientv3.OpPut(r.cfg.etcdKey("b", secretKey), notBefore, clientv3.WithLease(secretLease.ID)))
+	}
+	if len(req.AllowedCIDRs) > 0 {
+		ops = append(ops, clientv3.OpPut(r.cfg.etcdKey("c", secretKey), formatCIDRs(req.AllowedCIDRs), clientv3.WithLease(secretLease.ID)))
+	}
+	if req.Token != "" {
+		manageHash := hashValue(req.Token)
+		receipt, err := json.Marshal(&etcdReceipt{Key: secretKey, State: StatusPending, ExpireAt: expireAt})
+		if err != nil {
+			return "", err
+		}
+		ops = append(ops,
+			clientv3.OpPut(r.cfg.etcdKey("m", manageHash), string(receipt), clientv3.WithLease(retainLease.ID)),
+			clientv3.OpPut(r.cfg.etcdKey("t", secretKey), manageHash, clientv3.WithLease(secretLease.ID)),
+		)
+	}
+	_, err = r.client().Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		r.revokeLeases(ctx, int64(secretLease.ID), int64(retainLease.ID))
+		return "", err
+	}
+	return secretKey, nil
+}
+
+// Take reads a secret at its current revision, and then deletes it
+// only if it is still at that revision, so that concurrent requests
+// cannot both take the same secret.
+func (r *etcdStore) Take(ctx context.Context, secretKey string) (string, error) {
+	secretName := r.cfg.etcdKey("s", secretKey)
+	read, err := r.client().Txn(ctx).Then(
+		clientv3.OpGet(secretName),
+		clientv3.OpGet(r.cfg.etcdKey("e", secretKey)),
+		clientv3.OpGet(r.cfg.etcdKey("t", secretKey)),
+		clientv3.OpGet(r.cfg.etcdKey("b", secretKey)),
+	).Commit()
+	if err != nil {
+		return "", err
+	}
+	secrets := read.Responses[0].GetResponseRange().Kvs
+	expiry := read.Responses[1].GetResponseRange().Kvs
+	if len(expiry) == 0 {
+		return "", ErrNotFound
+	}
+	expireAt, err := strconv.ParseInt(string(expiry[0].Value), 10, 64)
+	if err != nil {
+		return "", err
+	}
+	// leases can outlive their TTL by a little
+	if expireAt <= r.now().Unix() {
+		return "", ErrExpired
+	}
+	if len(secrets) == 0 {
+		return "", ErrNotFound
+	}
+	notBefore, err := etcdNotBefore(read.Responses[3])
+	if err != nil {
+		return "", err
+	}
+	if notBefore.After(r.now()) {
+		return "", &LockedError{NotBefore: notBefore}
+	}
+	secret := secrets[0]
+
+	ops := []clientv3.Op{
+		clientv3.OpDelete(r.cfg.etcdKey("n", secretKey), clientv3.WithPrevKV()),
+		clientv3.OpDelete(secretName),
+		clientv3.OpDelete(r.cfg.etcdKey("e", secretKey)),
+		clientv3.OpDelete(r.cfg.etcdKey("b", secretKey)),
+		clientv3.OpDelete(r.cfg.etcdKey("c", secretKey)),
+		clientv3.OpDelete(r.cfg.etcdExpiryKey(expireAt, secretKey)),
+	}
+	var manageHash string
+	if tokens := read.Responses[2].GetResponseRange().Kvs; len(tokens) > 0 {
+		manageHash = string(tokens[0].Value)
+		ops = append(ops, clientv3.OpDelete(r.cfg.etcdKey("t", secretKey)))
+	}
+	resp, err := r.client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(secretName), "=", secret.ModRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return "", err
+	}
+	if !resp.Succeeded {
+		// taken or deleted since we read it
+		return "", ErrNotFound
+	}
+	if notified := resp.Responses[0].GetResponseDeleteRange().PrevKvs; len(notified) > 0 {
+		r.notify.send(string(notified[0].Value), &notifyEvent{Event: notifyRetrieved, Time: r.now().UTC(), ExpireAt: time.Unix(expireAt, 0).UTC()})
+	}
+	if manageHash != "" {
+		if err = r.setReceiptState(ctx, manageHash, StatusRetrieved); err != nil {
+			log.Warn("failed to update receipt", "err", err)
+		}
+		// the receipt keeps the retention lease
+		r.revokeLeases(ctx, secret.Lease)
+	} else {
+		r.revokeLeases(ctx, secret.Lease, expiry[0].Lease)
+	}
+	return string(secret.Value), nil
+}
+
+func (r *etcdStore) Peek(ctx context.Context, secretKey string) (*SecretPeek, error) {
+	read, err := r.client().Txn(ctx).Then(
+		clientv3.OpGet(r.cfg.etcdKey("s", secretKey)),
+		clientv3.OpGet(r.cfg.etcdKey("e", secretKey)),
+		clientv3.OpGet(r.cfg.etcdKey("b", secretKey)),
+		clientv3.OpGet(r.cfg.etcdKey("c", secretKey)),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	expiry := read.Responses[1].GetResponseRange().Kvs
+	if len(expiry) == 0 {
+		return nil, ErrNotFound
+	}
+	expireAt, err := strconv.ParseInt(string(expiry[0].Value), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if expireAt <= r.now().Unix() {
+		return nil, ErrExpired
+	}
+	secret := read.Responses[0].GetResponseRange().Kvs
+	if len(secret) == 0 {
+		return nil, ErrNotFound
+	}
+	notBefore, err := etcdNotBefore(read.Responses[2])
+	if err != nil {
+		return nil, err
+	}
+	var cidrs string
+	if kvs := read.Responses[3].GetResponseRange().Kvs; len(kvs) > 0 {
+		cidrs = string(kvs[0].Value)
+	}
+	allowed, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	peek := &SecretPeek{Exists: true, ExpireAt: time.Unix(expireAt, 0).UTC(), NotBefore: notBefore, AllowedCIDRs: allowed}
+	peek.payload = payloadRef(string(secret[0].Value))
+	return peek, nil
+}
+
+// etcdNotBefore is zero for secrets that can be taken at once.
+func etcdNotBefore(read *etcdserverpb.ResponseOp) (time.Time, error) {
+	kvs := read.GetResponseRange().Kvs
+	if len(kvs) == 0 {
+		return time.Time{}, nil
+	}
+	unix, err := strconv.ParseInt(string(kvs[0].Value), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0).UTC(), nil
+}
+
+func (r *etcdStore) Status(ctx context.Context, token string) (*SecretStatus, error) {
+	_, status, _, err := r.receipt(ctx, hashValue(token))
+	return status, err
+}
+
+func (r *etcdStore) Stats(ctx context.Context) (*Stats, error) {
+	counted, err := r.client().Get(ctx, r.cfg.etcdKey("s", ""), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{Secrets: int(counted.Count)}
+
+	// taken and deleted secrets are no longer in the expiry index
+	from := r.cfg.etcdExpiryKey(r.now().Unix()+1, "")
+	end := clientv3.GetPrefixRangeEnd(r.cfg.etcdKey("x", ""))
+	for _, order := range []clientv3.SortOrder{clientv3.SortAscend, clientv3.SortDescend} {
+		resp, err := r.client().Get(ctx, from,
+			clientv3.WithRange(end),
+			clientv3.WithSort(clientv3.SortByKey, order),
+			clientv3.WithLimit(1),
+			clientv3.WithKeysOnly())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			expireAt, _, err := r.parseExpiryKey(string(kv.Key))
+			if err != nil {
+				return nil, err
+			}
+			if order == clientv3.SortAscend {
+				stats.OldestExpireAt = time.Unix(expireAt, 0).UTC()
+			} else {
+				stats.NewestExpireAt = time.Unix(expireAt, 0).UTC()
+			}
+		}
+	}
+	return stats, nil
+}
+
+func (r *etcdStore) Delete(ctx context.Context, token string) (*SecretStatus, error) {
+	manageHash := hashValue(token)
+	receipt, status, revision, err := r.receipt(ctx, manageHash)
+	if err != nil || status.State != StatusPending {
+		return status, err
+	}
+	secretKey := receipt.Key
+	secretName := r.cfg.etcdKey("s", secretKey)
+	receiptName := r.cfg.etcdKey("m", manageHash)
+	receipt.State = StatusRevoked
+	revoked, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(secretName), ">", 0),
+			clientv3.Compare(clientv3.ModRevision(receiptName), "=", revision),
+		).
+		Then(
+			clientv3.OpDelete(secretName, clientv3.WithPrevKV()),
+			clientv3.OpDelete(r.cfg.etcdKey("e", secretKey)),
+			clientv3.OpDelete(r.cfg.etcdKey("b", secretKey)),
+			clientv3.OpDelete(r.cfg.etcdKey("c", secretKey)),
+			clientv3.OpDelete(r.cfg.etcdKey("t", secretKey)),
+			clientv3.OpDelete(r.cfg.etcdKey("n", secretKey)),
+			clientv3.OpDelete(r.cfg.etcdExpiryKey(receipt.ExpireAt, secretKey)),
+			clientv3.OpPut(receiptName, string(revoked), clientv3.WithIgnoreLease()),
+		).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		// retrieved or expired since we last looked
+		_, status, _, err = r.receipt(ctx, manageHash)
+		return status, err
+	}
+	event := newAuditEvent(auditBurned, secretKey)
+	event.ExpireAt = status.ExpireAt
+	r.audit.record(event)
+	status.State = StatusRevoked
+	if revoked := resp.Responses[0].GetResponseDeleteRange().PrevKvs; len(revoked) > 0 {
+		status.payload = payloadRef(string(revoked[0].Value))
+		r.revokeLeases(ctx, revoked[0].Lease)
+	}
+	return status, nil
+}
+
+// revokeLeases releases the leases of secrets that are gone, rather
+// than leave them to their TTL. Failures are only logged, since etcd
+// still revokes the leases when they expire.
+func (r *etcdStore) revokeLeases(ctx context.Context, ids ...int64) {
+	for _, id := range ids {
+		_, err := r.client().Revoke(ctx, clientv3.LeaseID(id))
+		if err != nil && !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			log.Warn("failed to revoke lease", "err", err)
+		}
+	}
+}
+
+func (r *etcdStore) rekey(ctx context.Context, keys KeyProvider) (int, error) {
+	prefix := r.cfg.etcdKey("s", "")
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	var count int
+	for from := prefix; ; {
+		resp, err := r.client().Get(ctx, from, clientv3.WithRange(end), clientv3.WithLimit(etcdExpiryBatch))
+		if err != nil {
+			return count, err
+		}
+		for _, kv := range resp.Kvs {
+			name, value := string(kv.Key), string(kv.Value)
+			keyHash := hashValue(strings.TrimPrefix(name, prefix))
+			if !needsRekey(keys, value, keyHash) {
+				continue
+			}
+			sealed, err := resealValue(ctx, keys, value, keyHash)
+			if err != nil {
+				return count, err
+			}
+			// retrieved secrets are not recreated
+			txn, err := r.client().Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(name), "=", kv.ModRevision)).
+				Then(clientv3.OpPut(name, sealed, clientv3.WithIgnoreLease())).
+				Commit()
+			if err != nil {
+				return count, err
+			}
+			if txn.Succeeded {
+				count++
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return count, nil
+		}
+		from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// receipt returns the stored receipt along with its revision,
+// so that changes to it can be made conditional on that revision.
+func (r *etcdStore) receipt(ctx context.Context, manageHash string) (*etcdReceipt, *SecretStatus, int64, error) {
+	resp, err := r.client().Get(ctx, r.cfg.etcdKey("m", manageHash))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil, 0, ErrNotFound
+	}
+	receipt := &etcdReceipt{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, receipt); err != nil {
+		return nil, nil, 0, err
+	}
+	status := &SecretStatus{
+		State:    receipt.State,
+		ExpireAt: time.Unix(receipt.ExpireAt, 0).UTC(),
+	}
+	if status.State == StatusPending && !status.ExpireAt.After(r.now()) {
+		status.State = StatusExpired
+	}
+	return receipt, status, resp.Kvs[0].ModRevision, nil
+}
+
+// setReceiptState keeps the lease of the receipt, and
+// does nothing when the receipt has already expired.
+func (r *etcdStore) setReceiptState(ctx context.Context, manageHash, state string) error {
+	receipt, _, revision, err := r.receipt(ctx, manageHash)
+	if err != nil {
+		return err
+	}
+	receipt.State = state
+	value, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	name := r.cfg.etcdKey("m", manageHash)
+	_, err = r.client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(name), "=", revision)).
+		Then(clientv3.OpPut(name, string(value), clientv3.WithIgnoreLease())).
+		Commit()
+	return err
+}
+
+func (r *etcdStore) parseExpiryKey(name string) (int64, string, error) {
+	entry := strings.TrimPrefix(name, r.cfg.etcdKey("x", ""))
+	expiry, secretKey, found := strings.Cut(entry, "/")
+	if !found {
+		return 0, "", fmt.Errorf("invalid expiry index key %q", name)
+	}
+	expireAt, err := strconv.ParseInt(expiry, 10, 64)
+	return expireAt, secretKey, err
+}
+
+func (r *etcdStore) regularExpiryPolling(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.NotifyPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.expireSecrets(ctx, now)
+		}
+	}
+}
+
+// expireSecrets finds secrets that were not retrieved before their
+// expiry, since retrieval removes secrets from the expiry index.
+func (r *etcdStore) expireSecrets(ctx context.Context, now time.Time) {
+	resp, err := r.client().Get(ctx, r.cfg.etcdKey("x", ""),
+		clientv3.WithRange(r.cfg.etcdExpiryKey(now.Unix()+1, "")),
+		clientv3.WithLimit(etcdExpiryBatch),
+		clientv3.WithKeysOnly())
+	if err != nil {
+		log.Warn("expire secrets failed", "err", err)
+		return
+	}
+	for _, kv := range resp.Kvs {
+		expireAt, secretKey, err := r.parseExpiryKey(string(kv.Key))
+		if err != nil {
+			log.Warn("expire secrets failed", "err", err)
+			continue
+		}
+		// claim the entry so that other instances do not report it as well
+		name := string(kv.Key)
+		claim, err := r.client().Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(name), ">", 0)).
+			Then(
+				clientv3.OpDelete(name),
+				clientv3.OpDelete(r.cfg.etcdKey("n", secretKey), clientv3.WithPrevKV()),
+			).
+			Commit()
+		if err != nil {
+			log.Warn("expire secrets failed", "err", err)
+			return
+		}
+		if !claim.Succeeded {
+			continue
+		}
+		event := newAuditEvent(auditExpired, secretKey)
+		event.ExpireAt = time.Unix(expireAt, 0).UTC()
+		r.audit.record(event)
+		if notified := claim.Responses[1].GetResponseDeleteRange().PrevKvs; len(notified) > 0 {
+			r.notify.send(string(notified[0].Value), &notifyEvent{Event: notifyExpired, Time: now.UTC(), ExpireAt: event.ExpireAt})
+		}
+	}
+}
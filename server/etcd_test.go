@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"gotest.tools/v3/assert"
+)
+
+// testEtcd starts an embedded single-node etcd server.
+func testEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL := url.URL{Scheme: "http", Host: testFreeAddr(t)}
+	peerURL := url.URL{Scheme: "http", Host: testFreeAddr(t)}
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peerURL.String())
+
+	etcd, err := embed.StartEtcd(cfg)
+	assert.NilError(t, err)
+	t.Cleanup(etcd.Close)
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd did not start")
+	}
+	return clientURL.String()
+}
+
+func testFreeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func testEtcdStore(t *testing.T, endpoint, ns string) *etcdStore {
+	cfg := testConfig()
+	cfg.EtcdEndpoints = endpoint
+	cfg.EtcdNS = ns
+	client, err := cfg.newEtcdClient()
+	assert.NilError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return &etcdStore{cfg: cfg, db: client, now: time.Now}
+}
+
+func TestEtcdRoundTrip(t *testing.T) {
+	store := testEtcdStore(t, testEtcd(t), "")
+	ctx := context.Background()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+	})
+	assert.NilError(t, err)
+
+	// the secret is held by a lease of its TTL
+	resp, err := store.db.Get(ctx, "s/"+key)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+	lease, err := store.db.TimeToLive(ctx, clientv3.LeaseID(resp.Kvs[0].Lease))
+	assert.NilError(t, err)
+	assert.Assert(t, lease.GrantedTTL == int64(time.Hour.Seconds()))
+
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestEtcdRevokeLeases(t *testing.T) {
+	store := testEtcdStore(t, testEtcd(t), "")
+	ctx := context.Background()
+	leases := func() int {
+		resp, err := store.db.Leases(ctx)
+		assert.NilError(t, err)
+		return len(resp.Leases)
+	}
+
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, leases())
+	_, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, leases())
+
+	// receipts keep the retention lease
+	token := NewSecretKey()
+	key, err = store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour, Token: token})
+	assert.NilError(t, err)
+	_, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, leases())
+	status, err := store.Status(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusRetrieved, status.State)
+
+	token = NewSecretKey()
+	_, err = store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour, Token: token})
+	assert.NilError(t, err)
+	_, err = store.Delete(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, leases())
+	status, err = store.Status(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusRevoked, status.State)
+}
+
+func TestEtcdTakeOnce(t *testing.T) {
+	store := testEtcdStore(t, testEtcd(t), "")
+	ctx := context.Background()
+
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for range 10 {
+		wg.Go(func() {
+			if _, err := store.Take(ctx, key); err == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, 1, taken)
+}
+
+func TestEtcdNamespace(t *testing.T) {
+	endpoint := testEtcd(t)
+	one := testEtcdStore(t, endpoint, "one")
+	two := testEtcdStore(t, endpoint, "two")
+	ctx := context.Background()
+
+	key, err := one.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+
+	resp, err := one.db.Get(ctx, "one/s/"+key)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+
+	_, err = two.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	stats, err := two.Stats(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, stats.Secrets)
+
+	secret, err := one.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
+
+func TestEtcdExpireSecrets(t *testing.T) {
+	store := testEtcdStore(t, testEtcd(t), "")
+	ctx := context.Background()
+
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	expired, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	taken, err := store.Put(ctx, &SecretWithTTL{Secret: "wobble", TTL: time.Hour})
+	assert.NilError(t, err)
+	_, err = store.Take(ctx, taken)
+	assert.NilError(t, err)
+
+	store.expireSecrets(ctx, now.Add(2*time.Hour))
+
+	// only secrets that expired unread are claimed from the index
+	resp, err := store.db.Get(ctx, "x/", clientv3.WithPrefix())
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(resp.Kvs))
+
+	now = now.Add(2 * time.Hour)
+	_, err = store.Take(ctx, expired)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestEtcdReloadPassword(t *testing.T) {
+	endpoint := testEtcd(t)
+	ctx := context.Background()
+
+	admin := testEtcdStore(t, endpoint, "").db
+	_, err := admin.UserAdd(ctx, "root", "first")
+	assert.NilError(t, err)
+	_, err = admin.UserGrantRole(ctx, "root", "root")
+	assert.NilError(t, err)
+	_, err = admin.AuthEnable(ctx)
+	assert.NilError(t, err)
+
+	path := filepath.Join(t.TempDir(), "etcd_pass")
+	assert.NilError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+	c := testConfig()
+	c.EtcdEndpoints = endpoint
+	c.EtcdUser = "root"
+	c.EtcdPassFile = path
+	assert.NilError(t, c.loadCredentialFiles())
+	store, err := c.newEtcdStore(t.Context(), nil, nil)
+	assert.NilError(t, err)
+	defer store.Close()
+
+	_, err = store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	first := store.(*etcdStore).client()
+
+	_, err = first.UserChangePassword(ctx, "root", "second")
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(path, []byte("second\n"), 0o600))
+	c.reloadCredentialFiles()
+
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: "wobble", TTL: time.Hour})
+	assert.NilError(t, err)
+	assert.Assert(t, store.(*etcdStore).client() != first)
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wobble", secret)
+}
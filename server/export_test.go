@@ -0,0 +1,55 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Openers for the conformance tests of the storetest package,
+// which cannot be imported by the tests of this package.
+
+// OpenSqliteTestStore uses a database file, rather than an in-memory
+// database, so that concurrent requests use separate connections.
+func OpenSqliteTestStore(t *testing.T) (Store, func(time.Duration)) {
+	c := testConfig()
+	c.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+	store, err := c.newSqliteStore(t.Context(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.(*sqliteStore).now = func() time.Time { return now }
+	return store, func(d time.Duration) { now = now.Add(d) }
+}
+
+func OpenRedisTestStore(t *testing.T) (Store, func(time.Duration)) {
+	mr := miniredis.RunT(t)
+	pool := &redis.Pool{
+		MaxIdle:      3,
+		IdleTimeout:  time.Minute,
+		Dial:         func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) },
+		TestOnBorrow: redisTestFunc,
+	}
+	var offset time.Duration
+	store := &redisStore{cfg: testConfig(), db: pool, now: func() time.Time { return time.Now().Add(offset) }}
+	return store, func(d time.Duration) {
+		offset += d
+		mr.FastForward(d)
+	}
+}
+
+func OpenMemoryTestStore(t *testing.T) (Store, func(time.Duration)) {
+	store, now := testMemoryStore(t, 0)
+	return store, func(d time.Duration) { *now = now.Add(d) }
+}
+
+func OpenEtcdTestStore(t *testing.T) (Store, func(time.Duration)) {
+	store := testEtcdStore(t, testEtcd(t), "")
+	var offset time.Duration
+	store.now = func() time.Time { return time.Now().Add(offset) }
+	return store, func(d time.Duration) { offset += d }
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/httplimit"
+	"github.com/streadway/handy/breaker"
+
+	"github.com/digitalocean-labs/goldfish/app"
+)
+
+// manageTokenHeader returns the token that lets
+// the creator of a secret check on or revoke it.
+const manageTokenHeader = "X-Manage-Token"
+
+func (c *config) newHandler(secrets Store, limits limiter.Store, audit *auditLog) http.Handler {
+	mux := http.NewServeMux()
+	rate := c.newRateLimiter(limits)
+	clientIP := c.newClientIPFunc()
+	mux.Handle("/{$}", http.RedirectHandler("/app/", http.StatusFound))
+	mux.Handle("/app/", staticCacheControl(http.StripPrefix("/app", http.FileServer(app.FS))))
+	mux.Handle("POST /push", rate.Handle(dynamicCacheControl(c.setSecret(secrets, audit))))
+	mux.Handle("POST /pull", rate.Handle(dynamicCacheControl(getSecret(secrets, audit, clientIP))))
+	mux.Handle("POST /peek", rate.Handle(dynamicCacheControl(peekSecret(secrets))))
+	mux.Handle("POST /status", rate.Handle(dynamicCacheControl(getStatus(secrets))))
+	mux.Handle("POST /revoke", rate.Handle(dynamicCacheControl(revokeSecret(secrets))))
+	if c.AdminToken != "" {
+		mux.Handle("GET /admin/stats", rate.Handle(dynamicCacheControl(c.requireAdmin(getStats(secrets)))))
+	}
+	return circuitBreaker(c.BreakerRatio, panicRecovery(csrfMiddleware(mux)))
+}
+
+func staticCacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := w.Header()
+		// Ref: https://web.dev/articles/http-cache
+		if app.Embedded {
+			headers.Set("Cache-Control", "no-cache")
+		} else {
+			headers.Set("Cache-Control", "no-store")
+		}
+		setSecurityHeaders(headers)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func dynamicCacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := w.Header()
+		// Ref: https://web.dev/articles/http-cache
+		headers.Set("Cache-Control", "no-store")
+		setSecurityHeaders(headers)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ref: https://blog.appcanary.com/2017/http-security-headers.html
+func setSecurityHeaders(headers http.Header) {
+	headers.Set("X-XSS-Protection", "1; mode=block")
+	headers.Set("X-Content-Type-Options", "nosniff")
+	headers.Set("X-Frame-Options", "DENY")
+}
+
+func circuitBreaker(ratio float64, handler http.Handler) http.Handler {
+	if ratio > 0 {
+		cb := breaker.NewBreaker(ratio)
+		return breaker.Handler(cb, breaker.DefaultStatusCodeValidator, handler)
+	}
+	return handler
+}
+
+func panicRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				stack := string(debug.Stack())
+				err := fmt.Errorf("panic: %v; stack: %s", p, stack)
+				internalError(w, err)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+var csrfSafeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+var csrfSafeFetches = map[string]bool{
+	"same-origin": true,
+	"none":        true,
+}
+
+// adapted from https://github.com/golang/go/issues/73626
+func csrfCheck(r *http.Request) error {
+	if csrfSafeMethods[r.Method] {
+		return nil
+	}
+	secFetchSite := r.Header.Get("Sec-Fetch-Site")
+	if csrfSafeFetches[secFetchSite] {
+		return nil
+	}
+	origin := r.Header.Get("Origin")
+	if secFetchSite == "" {
+		if origin == "" {
+			return errors.New("not a browser request")
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil {
+			return fmt.Errorf("bad origin: %w", err)
+		}
+		if parsed.Host == r.Host {
+			return nil
+		}
+	}
+	return fmt.Errorf("Sec-Fetch-Site %q, Origin %q, Host %q", secFetchSite, origin, r.Host)
+}
+
+func csrfMiddleware(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := csrfCheck(r); err != nil {
+			errorID := newErrorID()
+			log.Error("csrf check failed", "err_id", errorID, "err", err)
+			http.Error(w, fmt.Sprintf("Error ID: %s", errorID), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func getSecret(store Store, audit *auditLog, clientIP httplimit.KeyFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := parseGetRequest(r)
+		if key == "" {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = checkAllowedCIDRs(r, store, key, audit, clientIP); err != nil {
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+				http.Error(w, "key not found or expired", http.StatusNotFound)
+			} else if errors.Is(err, errRefused) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			} else {
+				internalError(w, err)
+			}
+			return
+		}
+		secret, err := store.Take(r.Context(), key)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+			http.Error(w, "key not found or expired", http.StatusNotFound)
+			return
+		}
+		var locked *LockedError
+		if errors.As(err, &locked) {
+			wait := max(int(math.Ceil(time.Until(locked.NotBefore).Seconds())), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(wait))
+			http.Error(w, locked.Error(), http.StatusLocked)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		event := newAuditEvent(auditViewed, key)
+		if ip, err := clientIP(r); err == nil {
+			event.clientIP = ip
+		}
+		audit.record(event)
+		writeSuccess(w, secret)
+	}
+}
+
+var errRefused = errors.New("secret cannot be retrieved from this network")
+
+// checkAllowedCIDRs refuses requests from outside the networks that
+// the sender of a secret chose, before the secret can be taken, so
+// that refused requests do not consume it. Allowed networks are
+// checked even if they are no longer configured, since the sender
+// relied on them.
+func checkAllowedCIDRs(r *http.Request, store Store, key string, audit *auditLog, clientIP httplimit.KeyFunc) error {
+	peek, err := store.Peek(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	if len(peek.AllowedCIDRs) == 0 {
+		return nil
+	}
+	ip, _ := clientIP(r)
+	addr, err := netip.ParseAddr(ip)
+	if err == nil && slices.ContainsFunc(peek.AllowedCIDRs, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr.Unmap())
+	}) {
+		return nil
+	}
+	event := newAuditEvent(auditRefused, key)
+	event.clientIP = ip
+	audit.record(event)
+	log.Warn("Refused secret retrieval", "key_hash", event.KeyHash, "viewer_ip_hash", event.ViewerIP)
+	return errRefused
+}
+
+// peekSecret does not tell apart unknown, taken, and expired
+// secrets, just as getSecret does not, so that it cannot be
+// used to learn any more about a key than getSecret could.
+func peekSecret(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := parseGetRequest(r)
+		if key == "" {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		peek, err := store.Peek(r.Context(), key)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+			writeJSON(w, &SecretPeek{})
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, peek)
+	}
+}
+
+func (c *config) setSecret(store Store, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, err := c.parseSetRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		secret.Token = NewSecretKey()
+		key, err := store.Put(r.Context(), secret)
+		if errors.Is(err, ErrFull) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		event := newAuditEvent(auditCreated, key)
+		event.TTL = int64(secret.TTL.Seconds())
+		event.ExpireAt = event.Time.Add(secret.TTL)
+		if c.AuditUserHeader != "" {
+			event.Creator = r.Header.Get(c.AuditUserHeader)
+		}
+		audit.record(event)
+		w.Header().Set(manageTokenHeader, secret.Token)
+		writeSuccess(w, key)
+	}
+}
+
+func getStatus(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := parseTokenRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := store.Status(r.Context(), token)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "token not found or expired", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, status)
+	}
+}
+
+func revokeSecret(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := parseTokenRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := store.Delete(r.Context(), token)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "token not found or expired", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, status)
+	}
+}
+
+func getStats(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := store.Stats(r.Context())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, stats)
+	}
+}
+
+func (c *config) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		admin := c.credential(&c.AdminToken)
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(admin)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func parseGetRequest(r *http.Request) (string, error) {
+	key := strings.TrimSpace(r.PostFormValue("key"))
+	if key == "" {
+		return "", errors.New("key is required")
+	}
+	if !validSecretKey.MatchString(key) {
+		return "", errors.New("key is invalid")
+	}
+	return key, nil
+}
+
+func parseTokenRequest(r *http.Request) (string, error) {
+	token := strings.TrimSpace(r.PostFormValue("token"))
+	if token == "" {
+		return "", errors.New("token is required")
+	}
+	if !validSecretKey.MatchString(token) {
+		return "", errors.New("token is invalid")
+	}
+	return token, nil
+}
+
+func (c *config) parseSetRequest(r *http.Request) (*SecretWithTTL, error) {
+	secret := strings.TrimSpace(r.PostFormValue("secret"))
+	if secret == "" {
+		return nil, errors.New("secret is required")
+	}
+	if len(secret) > c.maxSecretBytes() {
+		return nil, errors.New("secret is too long")
+	}
+	ttlTxt := strings.TrimSpace(r.PostFormValue("ttl"))
+	if ttlTxt == "" {
+		return nil, errors.New("ttl is required")
+	}
+	ttlHours, err := strconv.Atoi(ttlTxt)
+	if err != nil {
+		return nil, errors.New("ttl is invalid")
+	}
+	if ttlHours < 1 || ttlHours > 72 {
+		return nil, errors.New("ttl is too long")
+	}
+	ttl := time.Duration(ttlHours) * time.Hour
+	notify := strings.TrimSpace(r.PostFormValue("notify"))
+	if notify != "" {
+		if err = c.parseNotifyTarget(notify); err != nil {
+			return nil, err
+		}
+	}
+	var notBefore time.Time
+	if txt := strings.TrimSpace(r.PostFormValue("not_before")); txt != "" {
+		if notBefore, err = time.Parse(time.RFC3339, txt); err != nil {
+			return nil, errors.New("not_before is invalid")
+		}
+		if !notBefore.Before(time.Now().Add(ttl)) {
+			return nil, errors.New("not_before is after the secret expires")
+		}
+	}
+	var allowed []netip.Prefix
+	if txt := strings.TrimSpace(r.PostFormValue("cidrs")); txt != "" {
+		if allowed, err = c.parseAllowedCIDRs(txt); err != nil {
+			return nil, err
+		}
+	}
+	return &SecretWithTTL{
+		Secret:       secret,
+		TTL:          ttl,
+		Notify:       notify,
+		NotBefore:    notBefore,
+		AllowedCIDRs: allowed,
+	}, nil
+}
+
+// parseAllowedCIDRs only accepts networks
+// within those that have been configured.
+func (c *config) parseAllowedCIDRs(txt string) ([]netip.Prefix, error) {
+	if c.AllowedCIDRs == "" {
+		return nil, errors.New("cidrs are not enabled")
+	}
+	configured, err := parseCIDRs(c.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := parseCIDRs(txt)
+	if err != nil {
+		return nil, errors.New("cidrs are invalid")
+	}
+	for _, prefix := range allowed {
+		within := func(outer netip.Prefix) bool {
+			return outer.Bits() <= prefix.Bits() && outer.Contains(prefix.Addr())
+		}
+		if !slices.ContainsFunc(configured, within) {
+			return nil, fmt.Errorf("cidr %s is not allowed", prefix)
+		}
+	}
+	return allowed, nil
+}
+
+// maxSecretBytes allows larger secrets when they can
+// be kept in a bucket rather than in the backend.
+func (c *config) maxSecretBytes() int {
+	if c.S3Bucket != "" {
+		return c.S3MaxBytes
+	}
+	return 4096
+}
+
+func writeSuccess(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, msg)
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func internalError(w http.ResponseWriter, err error) {
+	errorID := newErrorID()
+	log.Error("request failed", "err_id", errorID, "err", err)
+	http.Error(w, fmt.Sprintf("Error ID: %s", errorID), http.StatusInternalServerError)
+}
+
+func newErrorID() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("%x", buf)
+}
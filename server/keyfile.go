@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var validKeyID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// fileKeyProvider holds key-encryption keys read from a file or the
+// environment. The primary key wraps new data keys, and all keys can
+// unwrap them, so that keys can be rotated.
+type fileKeyProvider struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// newFileKeyProvider returns nil when no keys have been configured,
+// which leaves encryption at rest to be disabled.
+func (c *config) newFileKeyProvider() (KeyProvider, error) {
+	var entries []string
+	if c.EncryptionKeys != "" {
+		entries = append(entries, strings.Split(c.EncryptionKeys, ",")...)
+	}
+	if c.EncryptionKeysFile != "" {
+		data, err := os.ReadFile(c.EncryptionKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, strings.Split(string(data), "\n")...)
+	}
+	keys, err := parseFileKeys(entries)
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	log.Info("Encrypting secrets at rest", "provider", FileKeyProvider, "key_id", keys.primary)
+	return keys, nil
+}
+
+// parseFileKeys reads "id=base64key" entries, where each
+// key is 32 bytes long and the first entry is the primary.
+func parseFileKeys(entries []string) (*fileKeyProvider, error) {
+	ring := &fileKeyProvider{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, "=")
+		if !ok || !validKeyID.MatchString(id) {
+			return nil, errors.New("encryption keys must be id=base64key entries")
+		}
+		if _, found := ring.keys[id]; found {
+			return nil, fmt.Errorf("duplicate encryption key %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[id] = aead
+		if ring.primary == "" {
+			ring.primary = id
+		}
+	}
+	if ring.primary == "" {
+		return nil, nil
+	}
+	return ring, nil
+}
+
+func (k *fileKeyProvider) KeyID() string {
+	return k.primary
+}
+
+func (k *fileKeyProvider) WrapKey(_ context.Context, dataKey []byte) ([]byte, error) {
+	return aeadSeal(k.keys[k.primary], dataKey, []byte(k.primary))
+}
+
+func (k *fileKeyProvider) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	kek, found := k.keys[keyID]
+	if !found {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	return aeadOpen(kek, wrapped, []byte(keyID))
+}
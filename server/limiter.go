@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/httplimit"
+	"github.com/sethvargo/go-limiter/memorystore"
+	"github.com/sethvargo/go-limiter/noopstore"
+	"github.com/sethvargo/go-redisstore"
+)
+
+func (c *config) newRateLimiter(store limiter.Store) *httplimit.Middleware {
+	mw, err := httplimit.NewMiddleware(store, c.newLimiterKeyFunc())
+	if err != nil {
+		// store and key function are never nil here
+		panic(err)
+	}
+	return mw
+}
+
+// newClientIPFunc resolves the client IP address of a request,
+// trusting the configured headers before the remote address.
+func (c *config) newClientIPFunc() httplimit.KeyFunc {
+	var headers []string
+	if len(c.LimitHeaders) > 0 {
+		headers = strings.Split(c.LimitHeaders, ",")
+	}
+	return httplimit.IPKeyFunc(headers...)
+}
+
+func (c *config) newLimiterKeyFunc() httplimit.KeyFunc {
+	keyFunc := c.newClientIPFunc()
+	if c.Backend != RedisBackend && c.Backend != SqliteBackend {
+		return keyFunc
+	}
+	// client IPs are not kept in plaintext outside of the process
+	return func(r *http.Request) (string, error) {
+		key, err := keyFunc(r)
+		if err != nil {
+			return "", err
+		}
+		if c.Backend == SqliteBackend {
+			return hashValue(key), nil
+		}
+		return c.redisKey("h", hashValue(key)), nil
+	}
+}
+
+func (c *config) newLimiterStore() (limiter.Store, error) {
+	if c.LimitCount == 0 {
+		return noopstore.New()
+	}
+	if c.Backend == SqliteBackend {
+		store, err := c.newSqliteLimiterStore()
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	if c.Backend != RedisBackend {
+		return memorystore.New(&memorystore.Config{
+			Tokens:   c.LimitCount,
+			Interval: c.LimitPeriod,
+		})
+	}
+	cfg := &redisstore.Config{
+		Tokens:   c.LimitCount,
+		Interval: c.LimitPeriod,
+	}
+	db, err := c.newRedisPool()
+	if err != nil {
+		return nil, err
+	}
+	if pool, ok := db.(*redis.Pool); ok {
+		return redisstore.NewWithPool(cfg, pool)
+	}
+	// the limiter needs a redis.Pool, so we let it pool cluster connections
+	pool := c.newRedisConnPool(func() (redis.Conn, error) { return db.Get(), nil }, nil)
+	store, err := redisstore.NewWithPool(cfg, pool)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterLimiterStore{Store: store, db: db}, nil
+}
+
+type clusterLimiterStore struct {
+	limiter.Store
+	db redisPool
+}
+
+func (s *clusterLimiterStore) Close(ctx context.Context) error {
+	return errors.Join(s.Store.Close(ctx), s.db.Close())
+}
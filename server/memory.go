@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	log "log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps secrets only in process memory, so that nothing is
+// ever written to disk. Secret values are kept in locked memory, where
+// the platform allows it, and are zeroed when they leave the store.
+type memoryStore struct {
+	mu       sync.Mutex
+	secrets  map[string]*memorySecret
+	receipts map[string]*memoryReceipt // by hashed management token
+	size     int
+	maxBytes int
+	now      func() time.Time
+	audit    *auditLog
+	notify   *notifier
+	warnLock sync.Once
+}
+
+type memorySecret struct {
+	value     []byte
+	expireAt  time.Time
+	notBefore time.Time
+	cidrs     []netip.Prefix
+	notify    string
+	receipt   string
+}
+
+type memoryReceipt struct {
+	key      string
+	state    string
+	expireAt time.Time
+}
+
+func (c *config) newMemoryStore(ctx context.Context, audit *auditLog, notify *notifier) (Store, error) {
+	log.Info("Using in-memory secret store", "maxBytes", c.MemoryMaxBytes)
+	store := &memoryStore{
+		secrets:  make(map[string]*memorySecret),
+		receipts: make(map[string]*memoryReceipt),
+		maxBytes: c.MemoryMaxBytes,
+		now:      time.Now,
+		audit:    audit,
+		notify:   notify,
+	}
+	go store.regularMemoryCleanup(ctx, c.MemoryClean)
+	return store, nil
+}
+
+func (m *memoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, secret := range m.secrets {
+		m.remove(key, secret)
+	}
+	return nil
+}
+
+func (m *memoryStore) Put(_ context.Context, req *SecretWithTTL) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size := len(req.Secret)
+	if m.maxBytes > 0 && m.size+size > m.maxBytes {
+		return "", ErrFull
+	}
+	value, locked, err := lockedAlloc(size)
+	if err != nil {
+		return "", err
+	}
+	if !locked {
+		m.warnLock.Do(func() {
+			log.Warn("Failed to lock memory, secrets may be written to swap")
+		})
+	}
+	copy(value, req.Secret)
+	key := req.newKey()
+	secret := &memorySecret{value: value, expireAt: m.now().Add(req.TTL), notBefore: req.NotBefore, cidrs: req.AllowedCIDRs, notify: req.Notify}
+	if req.Token != "" {
+		secret.receipt = hashValue(req.Token)
+		m.receipts[secret.receipt] = &memoryReceipt{key: key, state: StatusPending, expireAt: secret.expireAt}
+	}
+	m.secrets[key] = secret
+	m.size += size
+	return key, nil
+}
+
+func (m *memoryStore) Take(_ context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secret, found := m.secrets[key]
+	if !found {
+		return "", ErrNotFound
+	}
+	// expired secrets are left for regularMemoryCleanup to report
+	if !secret.expireAt.After(m.now()) {
+		return "", ErrExpired
+	}
+	if secret.notBefore.After(m.now()) {
+		return "", &LockedError{NotBefore: secret.notBefore.UTC()}
+	}
+	value := string(secret.value)
+	m.remove(key, secret)
+	if receipt, found := m.receipts[secret.receipt]; found {
+		receipt.state = StatusRetrieved
+	}
+	if secret.notify != "" {
+		m.notify.send(secret.notify, &notifyEvent{Event: notifyRetrieved, Time: m.now().UTC(), ExpireAt: secret.expireAt.UTC()})
+	}
+	return value, nil
+}
+
+func (m *memoryStore) Peek(_ context.Context, key string) (*SecretPeek, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secret, found := m.secrets[key]
+	if !found {
+		return nil, ErrNotFound
+	}
+	if !secret.expireAt.After(m.now()) {
+		return nil, ErrExpired
+	}
+	peek := &SecretPeek{Exists: true, ExpireAt: secret.expireAt.UTC(), NotBefore: secret.notBefore.UTC(), AllowedCIDRs: secret.cidrs}
+	if bytes.HasPrefix(secret.value, []byte(payloadPrefix)) {
+		peek.payload = string(secret.value)
+	}
+	return peek, nil
+}
+
+func (m *memoryStore) Status(_ context.Context, token string) (*SecretStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	receipt, found := m.receipts[hashValue(token)]
+	if !found {
+		return nil, ErrNotFound
+	}
+	status := &SecretStatus{State: receipt.state, ExpireAt: receipt.expireAt.UTC()}
+	if status.State == StatusPending && !receipt.expireAt.After(m.now()) {
+		status.State = StatusExpired
+	}
+	return status, nil
+}
+
+func (m *memoryStore) Delete(_ context.Context, token string) (*SecretStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	receipt, found := m.receipts[hashValue(token)]
+	if !found {
+		return nil, ErrNotFound
+	}
+	status := &SecretStatus{State: receipt.state, ExpireAt: receipt.expireAt.UTC()}
+	if status.State != StatusPending {
+		return status, nil
+	}
+	if !receipt.expireAt.After(m.now()) {
+		status.State = StatusExpired
+		return status, nil
+	}
+	if secret, found := m.secrets[receipt.key]; found {
+		if bytes.HasPrefix(secret.value, []byte(payloadPrefix)) {
+			status.payload = string(secret.value)
+		}
+		m.remove(receipt.key, secret)
+	}
+	receipt.state = StatusRevoked
+	event := newAuditEvent(auditBurned, receipt.key)
+	event.ExpireAt = status.ExpireAt
+	m.audit.record(event)
+	status.State = StatusRevoked
+	return status, nil
+}
+
+func (m *memoryStore) Stats(context.Context) (*Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	stats := &Stats{}
+	for _, secret := range m.secrets {
+		if !secret.expireAt.After(now) {
+			continue
+		}
+		stats.Secrets++
+		if stats.OldestExpireAt.IsZero() || secret.expireAt.Before(stats.OldestExpireAt) {
+			stats.OldestExpireAt = secret.expireAt
+		}
+		if secret.expireAt.After(stats.NewestExpireAt) {
+			stats.NewestExpireAt = secret.expireAt
+		}
+	}
+	stats.OldestExpireAt = stats.OldestExpireAt.UTC()
+	stats.NewestExpireAt = stats.NewestExpireAt.UTC()
+	return stats, nil
+}
+
+// remove must be called with the lock held.
+func (m *memoryStore) remove(key string, secret *memorySecret) {
+	m.size -= len(secret.value)
+	lockedFree(secret.value)
+	secret.value = nil
+	delete(m.secrets, key)
+}
+
+func (m *memoryStore) regularMemoryCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.expireSecrets(m.now())
+		}
+	}
+}
+
+func (m *memoryStore) expireSecrets(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, secret := range m.secrets {
+		if secret.expireAt.After(now) {
+			continue
+		}
+		m.remove(key, secret)
+		event := newAuditEvent(auditExpired, key)
+		event.ExpireAt = secret.expireAt.UTC()
+		m.audit.record(event)
+		if secret.notify != "" {
+			m.notify.send(secret.notify, &notifyEvent{Event: notifyExpired, Time: now.UTC(), ExpireAt: event.ExpireAt})
+		}
+	}
+	for hash, receipt := range m.receipts {
+		if receipt.expireAt.Before(now.Add(-statusRetention)) {
+			delete(m.receipts, hash)
+		}
+	}
+}
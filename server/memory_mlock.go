@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package server
+
+import "syscall"
+
+// lockedAlloc maps memory for a secret value outside of the Go heap, and
+// locks it so that it is not written to swap. The memory is still used
+// when it cannot be locked, such as beyond RLIMIT_MEMLOCK.
+func lockedAlloc(size int) (buf []byte, locked bool, err error) {
+	buf, err = syscall.Mmap(-1, 0, max(size, 1), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, false, err
+	}
+	return buf[:size], syscall.Mlock(buf) == nil, nil
+}
+
+// lockedFree zeroes and unmaps memory from lockedAlloc.
+func lockedFree(buf []byte) {
+	clear(buf)
+	syscall.Munmap(buf[:cap(buf)])
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package server
+
+// lockedAlloc cannot lock memory on this platform.
+func lockedAlloc(size int) (buf []byte, locked bool, err error) {
+	return make([]byte, size), false, nil
+}
+
+// lockedFree zeroes memory from lockedAlloc.
+func lockedFree(buf []byte) {
+	clear(buf)
+}
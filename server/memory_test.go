@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func testMemoryStore(t *testing.T, maxBytes int) (*memoryStore, *time.Time) {
+	now := time.Now()
+	store := &memoryStore{
+		secrets:  make(map[string]*memorySecret),
+		receipts: make(map[string]*memoryReceipt),
+		maxBytes: maxBytes,
+		now:      func() time.Time { return now },
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, &now
+}
+
+func TestMemoryMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	store, _ := testMemoryStore(t, 10)
+
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	assert.Equal(t, 6, store.size)
+
+	_, err = store.Put(ctx, &SecretWithTTL{Secret: "wobble", TTL: time.Hour})
+	assert.ErrorIs(t, err, ErrFull)
+
+	_, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, store.size)
+
+	_, err = store.Put(ctx, &SecretWithTTL{Secret: "wobble", TTL: time.Hour})
+	assert.NilError(t, err)
+}
+
+func TestMemoryMaxBytes_Handler(t *testing.T) {
+	c := testConfig()
+	store, _ := testMemoryStore(t, 4)
+	handler := c.setSecret(store, nil)
+
+	res := testPost(t, handler, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}})
+	assert.Equal(t, http.StatusInsufficientStorage, res.Code)
+}
+
+func TestMemoryExpireSecrets(t *testing.T) {
+	ctx := context.Background()
+	store, now := testMemoryStore(t, 0)
+	notify, target, received := testNotifier(t)
+	store.notify = notify
+
+	token := NewSecretKey()
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour, Notify: target, Token: token})
+	assert.NilError(t, err)
+
+	*now = now.Add(2 * time.Hour)
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	store.expireSecrets(*now)
+	assert.Equal(t, 0, store.size)
+	assert.Equal(t, 0, len(store.secrets))
+
+	select {
+	case event := <-received:
+		assert.Equal(t, notifyExpired, event.Event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	status, err := store.Status(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusExpired, status.State)
+
+	store.expireSecrets(now.Add(statusRetention))
+	_, err = store.Status(ctx, token)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestLockedAlloc(t *testing.T) {
+	for _, size := range []int{0, 6, 5000} {
+		buf, _, err := lockedAlloc(size)
+		assert.NilError(t, err)
+		assert.Equal(t, size, len(buf))
+		copy(buf, "wibble")
+		lockedFree(buf)
+	}
+}
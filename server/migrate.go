@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"time"
+
+	"github.com/tomcz/gotools/quiet"
+)
+
+// storedSecret is a secret as it is kept by a store. Migrated
+// secrets keep their key, so that shared links keep working.
+type storedSecret struct {
+	key        string
+	value      string
+	expireAt   time.Time
+	notify     string
+	manageHash string
+	notBefore  time.Time
+	cidrs      string
+}
+
+// migrateStore is implemented by backends that secrets can be migrated
+// between. Secret values are copied as stored, so encrypted values
+// need the same encryption keys in the destination.
+type migrateStore interface {
+	Store
+	// exportSecrets visits every unexpired secret,
+	// which may be removed by the visiting function.
+	exportSecrets(ctx context.Context, fn func(secret *storedSecret) error) error
+	importSecret(ctx context.Context, secret *storedSecret) error
+	// lookupSecret returns a secret value without taking it.
+	lookupSecret(ctx context.Context, key string) (string, error)
+	removeSecret(ctx context.Context, secret *storedSecret) error
+}
+
+// Migrate moves every unexpired secret from one backend to another, with
+// its remaining TTL, notification target, management token, not-before
+// time, and allowed CIDRs. Secrets are only removed from the source once
+// their copy has been read back from the destination, so an interrupted
+// migration can be run again.
+func Migrate(ctx context.Context, from, to Config) error {
+	if from == to {
+		return errors.New("cannot migrate secrets to the same backend")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	source, err := openMigrateStore(ctx, from)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer quiet.Close(source)
+
+	dest, err := openMigrateStore(ctx, to)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	defer quiet.Close(dest)
+
+	var count int
+	err = source.exportSecrets(ctx, func(secret *storedSecret) error {
+		err := migrateSecret(ctx, source, dest, secret)
+		if errors.Is(err, ErrExpired) {
+			// left to expire in the source
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", secret.key, err)
+		}
+		count++
+		return nil
+	})
+	log.Info("Migrated secrets", "count", count, "from", from.Backend, "to", to.Backend)
+	return err
+}
+
+func migrateSecret(ctx context.Context, source, dest migrateStore, secret *storedSecret) error {
+	// a previous migration may have stopped before removing the source
+	copied, err := dest.lookupSecret(ctx, secret.key)
+	if errors.Is(err, ErrNotFound) {
+		if err = dest.importSecret(ctx, secret); err != nil {
+			return err
+		}
+		copied, err = dest.lookupSecret(ctx, secret.key)
+	}
+	if err != nil {
+		return err
+	}
+	if copied != secret.value {
+		return errors.New("copied value does not match")
+	}
+	return source.removeSecret(ctx, secret)
+}
+
+func openMigrateStore(ctx context.Context, cfg Config) (migrateStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := loadConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	store, err := c.newBackendStore(ctx, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	migrate, ok := store.(migrateStore)
+	if !ok {
+		quiet.Close(store)
+		return nil, fmt.Errorf("backend %q does not support migration", c.Backend)
+	}
+	return migrate, nil
+}
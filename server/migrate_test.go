@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gotest.tools/v3/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	sqlite := DefaultConfig()
+	sqlite.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+
+	redis := DefaultConfig()
+	redis.Backend = RedisBackend
+	redis.RedisAddr = mr.Addr()
+	redis.RedisNS = "goldfish"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := newConfig(sqlite).newSqliteStore(ctx, nil, nil)
+	assert.NilError(t, err)
+	defer store.Close()
+
+	plainKey, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	token := NewSecretKey()
+	tokenKey, err := store.Put(ctx, &SecretWithTTL{Secret: "wobble", TTL: time.Hour, Notify: "https://example.com/hook", Token: token})
+	assert.NilError(t, err)
+	lockedKey, err := store.Put(ctx, &SecretWithTTL{Secret: "webble", TTL: time.Hour, NotBefore: time.Now().Add(30 * time.Minute), AllowedCIDRs: []netip.Prefix{netip.MustParsePrefix("10.8.0.0/16")}})
+	assert.NilError(t, err)
+	store.(*sqliteStore).now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	expiredKey, err := store.Put(ctx, &SecretWithTTL{Secret: "wubble", TTL: time.Hour})
+	assert.NilError(t, err)
+	store.(*sqliteStore).now = time.Now
+
+	assert.NilError(t, Migrate(ctx, sqlite, redis))
+
+	assert.Assert(t, mr.Exists("goldfish:s:"+plainKey))
+	assert.Assert(t, mr.Exists("goldfish:n:"+tokenKey))
+	assert.Assert(t, mr.Exists("goldfish:b:"+lockedKey))
+	cidrs, err := mr.Get("goldfish:c:" + lockedKey)
+	assert.NilError(t, err)
+	assert.Equal(t, "10.8.0.0/16", cidrs)
+	assert.Assert(t, !mr.Exists("goldfish:s:"+expiredKey))
+	ttl := mr.TTL("goldfish:s:" + tokenKey)
+	assert.Assert(t, ttl > 59*time.Minute && ttl <= time.Hour, ttl)
+
+	_, err = store.Take(ctx, plainKey)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Status(ctx, token)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Take(ctx, expiredKey)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	// and back again
+	assert.NilError(t, Migrate(ctx, redis, sqlite))
+	assert.Assert(t, !mr.Exists("goldfish:s:"+plainKey))
+	assert.Assert(t, !mr.Exists("goldfish:m:"+hashValue(token)))
+
+	secret, err := store.Take(ctx, plainKey)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+
+	status, err := store.Status(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusPending, status.State)
+
+	secret, err = store.Take(ctx, tokenKey)
+	assert.NilError(t, err)
+	assert.Equal(t, "wobble", secret)
+
+	_, err = store.Take(ctx, lockedKey)
+	assert.ErrorIs(t, err, ErrLocked)
+}
+
+func TestMigrate_Unsupported(t *testing.T) {
+	sqlite := DefaultConfig()
+	sqlite.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+
+	assert.ErrorContains(t, Migrate(context.Background(), sqlite, sqlite), "same backend")
+
+	memory := DefaultConfig()
+	memory.Backend = MemoryBackend
+	assert.ErrorContains(t, Migrate(context.Background(), memory, sqlite), "does not support migration")
+}
+
+func TestRedisKeyID(t *testing.T) {
+	for _, mode := range []string{RedisModeStandalone, RedisModeCluster} {
+		c := testConfig()
+		c.RedisMode, c.RedisNS = mode, "goldfish"
+		assert.Equal(t, "abc", c.redisKeyID("s", c.redisKey("s", "abc")))
+	}
+}
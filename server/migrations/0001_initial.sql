@@ -0,0 +1,22 @@
+-- The schema from before versioned migrations, which
+-- existing databases already have without a version.
+create table if not exists secrets (
+    secret_key    text      primary key,
+    secret_value  text      not null,
+    expire_at     timestamp not null
+);
+create index if not exists expireAtIdx on secrets (expire_at);
+create table if not exists notifications (
+    secret_key    text      primary key,
+    target        text      not null,
+    expire_at     timestamp not null
+);
+create index if not exists notifyExpireAtIdx on notifications (expire_at);
+create table if not exists receipts (
+    manage_hash   text      primary key,
+    secret_key    text      not null,
+    state         text      not null,
+    expire_at     timestamp not null
+);
+create index if not exists receiptKeyIdx on receipts (secret_key);
+create index if not exists receiptExpireAtIdx on receipts (expire_at);
@@ -0,0 +1,11 @@
+-- Token buckets of the rate-limiter, keyed by hashed client IP,
+-- with times in unix nanoseconds. Buckets are refilled on each
+-- tick of their interval since start_time.
+create table if not exists rate_limits (
+    limit_key     text      primary key,
+    max_tokens    integer   not null,
+    available     integer   not null,
+    interval_ns   integer   not null,
+    start_time    integer   not null,
+    last_tick     integer   not null
+);
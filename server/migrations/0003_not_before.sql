@@ -0,0 +1,3 @@
+-- Secrets that cannot be taken before a release time,
+-- which is null for secrets that can be taken at once.
+alter table secrets add column not_before timestamp;
@@ -0,0 +1,3 @@
+-- Comma-separated networks that a secret can be taken from,
+-- which is null for secrets that can be taken from anywhere.
+alter table secrets add column allowed_cidrs text;
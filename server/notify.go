@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	notifyRetrieved = "retrieved"
+	notifyExpired   = "expired"
+)
+
+const (
+	notifySlackPrefix = "slack+"
+	notifyMailScheme  = "mailto"
+	notifyQueue       = 100
+	notifyTimeout     = 10 * time.Second
+)
+
+// notifyEvent is sent to the creator of a secret. Like audit
+// events, it must never carry secret values or secret keys.
+type notifyEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+type notifyJob struct {
+	target string
+	event  *notifyEvent
+}
+
+// notifier delivers read receipts from a background worker.
+// A nil notifier is valid and discards all receipts.
+type notifier struct {
+	cfg    *config
+	client *http.Client
+	queue  chan *notifyJob
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (c *config) newNotifier() *notifier {
+	if !c.NotifyWebhooks && c.NotifySmtpAddr == "" {
+		return nil
+	}
+	n := &notifier{
+		cfg:    c,
+		client: newNotifyClient(),
+		queue:  make(chan *notifyJob, notifyQueue),
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// newNotifyClient only connects to public addresses, since webhook urls
+// come from anonymous creators, who must not be able to make the server
+// post to itself, to its private network, or to a cloud metadata service.
+// Proxies are not used, since they would connect on our behalf.
+func newNotifyClient() *http.Client {
+	dialer := &net.Dialer{Timeout: notifyTimeout, Control: checkNotifyAddr}
+	return &http.Client{
+		Timeout: notifyTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: notifyTimeout,
+		},
+	}
+}
+
+// checkNotifyAddr runs after host names are resolved,
+// so that they cannot resolve to a forbidden address.
+func checkNotifyAddr(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addr) {
+		return fmt.Errorf("notify address %s is not public", addr.Unmap())
+	}
+	return nil
+}
+
+// reservedNetworks are not public, but are neither private
+// nor local according to the netip package.
+var reservedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("3fff::/20"),
+}
+
+var (
+	nat64Network     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFourNetwork = netip.MustParsePrefix("2002::/16")
+)
+
+// isPublicAddr checks the IPv4 addresses that NAT64 and 6to4
+// addresses embed, since those are the ones that are reached.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+	ip := addr.As16()
+	if nat64Network.Contains(addr) {
+		return isPublicAddr(netip.AddrFrom4([4]byte(ip[12:16])))
+	}
+	if sixToFourNetwork.Contains(addr) {
+		return isPublicAddr(netip.AddrFrom4([4]byte(ip[2:6])))
+	}
+	return true
+}
+
+// parseNotifyTarget checks that a creator-supplied target is
+// one that this server has been configured to deliver to:
+//   - "https://..." posts a JSON notifyEvent to a webhook
+//   - "slack+https://..." posts a message to a Slack-compatible incoming webhook
+//   - "mailto:someone@example.com" sends an email via the configured SMTP server
+func (c *config) parseNotifyTarget(target string) error {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return errors.New("notify target is invalid")
+	}
+	switch parsed.Scheme {
+	case "https", notifySlackPrefix + "https":
+		if !c.NotifyWebhooks {
+			return errors.New("webhook notifications are disabled")
+		}
+		if parsed.Host == "" {
+			return errors.New("notify target is invalid")
+		}
+		return nil
+	case notifyMailScheme:
+		if c.NotifySmtpAddr == "" {
+			return errors.New("email notifications are disabled")
+		}
+		_, err = c.parseNotifyMail(parsed)
+		return err
+	default:
+		return errors.New("notify target is not supported")
+	}
+}
+
+// parseNotifyMail only accepts a bare address, without a display
+// name or query, so that mail is sent to the address that was checked.
+// Addresses are checked again before delivery, so that they can no
+// longer be sent to once they are removed from NotifyMailDomains.
+func (c *config) parseNotifyMail(parsed *url.URL) (*mail.Address, error) {
+	if parsed.RawQuery != "" || parsed.ForceQuery || parsed.Fragment != "" {
+		return nil, errors.New("notify target is invalid")
+	}
+	addr, err := mail.ParseAddress(parsed.Opaque)
+	if err != nil || addr.Address != parsed.Opaque {
+		return nil, errors.New("notify target is invalid")
+	}
+	domain := addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+	for _, allowed := range strings.Split(c.NotifyMailDomains, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "" {
+			continue
+		}
+		if strings.EqualFold(allowed, addr.Address) || strings.EqualFold(allowed, domain) {
+			return addr, nil
+		}
+	}
+	return nil, errors.New("notify email address is not allowed")
+}
+
+func (n *notifier) send(target string, event *notifyEvent) {
+	if n == nil || target == "" {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- &notifyJob{target: target, event: event}:
+	default:
+		log.Warn("notification dropped", "event", event.Event, "err", "queue is full")
+	}
+}
+
+func (n *notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	n.closed = true
+	close(n.queue)
+	n.mu.Unlock()
+	<-n.done
+	return nil
+}
+
+func (n *notifier) run() {
+	defer close(n.done)
+	for job := range n.queue {
+		if err := n.deliver(job); err != nil {
+			log.Warn("notification failed", "event", job.event.Event, "err", err)
+		}
+	}
+}
+
+func (n *notifier) deliver(job *notifyJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if slackURL, ok := strings.CutPrefix(job.target, notifySlackPrefix); ok {
+		body, err := json.Marshal(map[string]string{"text": notifyMessage(job.event)})
+		if err != nil {
+			return err
+		}
+		return n.post(ctx, slackURL, body)
+	}
+	if strings.HasPrefix(job.target, notifyMailScheme+":") {
+		parsed, err := url.Parse(job.target)
+		if err != nil {
+			return err
+		}
+		addr, err := n.cfg.parseNotifyMail(parsed)
+		if err != nil {
+			return err
+		}
+		return n.sendNotifyMail(addr.Address, job.event)
+	}
+	body, err := json.Marshal(job.event)
+	if err != nil {
+		return err
+	}
+	return n.post(ctx, job.target, body)
+}
+
+func (n *notifier) post(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %q", res.Status)
+	}
+	return nil
+}
+
+func notifyMessage(event *notifyEvent) string {
+	expireAt := event.ExpireAt.UTC().Format(time.RFC1123)
+	if event.Event == notifyRetrieved {
+		at := event.Time.UTC().Format(time.RFC1123)
+		return fmt.Sprintf("Your Goldfish secret, due to expire on %s, was retrieved on %s.", expireAt, at)
+	}
+	return fmt.Sprintf("Your Goldfish secret expired unread on %s.", expireAt)
+}
+
+func (n *notifier) sendNotifyMail(to string, event *notifyEvent) error {
+	c := n.cfg
+	var auth smtp.Auth
+	if c.NotifySmtpUser != "" {
+		host, _, err := net.SplitHostPort(c.NotifySmtpAddr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.NotifySmtpUser, c.credential(&c.NotifySmtpPass), host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.NotifySmtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: Goldfish secret %s\r\n", event.Event)
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprint(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", notifyMessage(event))
+	return smtp.SendMail(c.NotifySmtpAddr, auth, c.NotifySmtpFrom, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"gotest.tools/v3/assert"
+)
+
+func testNotifier(t *testing.T) (*notifier, string, <-chan *notifyEvent) {
+	received := make(chan *notifyEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notifyEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			received <- &event
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	n := &notifier{
+		client: server.Client(),
+		queue:  make(chan *notifyJob, notifyQueue),
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	t.Cleanup(func() { n.Close() })
+	return n, server.URL, received
+}
+
+func TestParseNotifyTarget(t *testing.T) {
+	c := testConfig()
+	c.NotifyWebhooks = true
+	c.NotifySmtpAddr = "localhost:25"
+	c.NotifyMailDomains = "example.com, ops@example.org"
+
+	assert.NilError(t, c.parseNotifyTarget("https://example.com/hook"))
+	assert.NilError(t, c.parseNotifyTarget("slack+https://hooks.slack.com/services/T0/B0/X"))
+	assert.NilError(t, c.parseNotifyTarget("mailto:someone@example.com"))
+	assert.ErrorContains(t, c.parseNotifyTarget("mailto:someone"), "invalid")
+	assert.ErrorContains(t, c.parseNotifyTarget("mailto:someone@example.com?cc=other@example.com"), "invalid")
+	assert.ErrorContains(t, c.parseNotifyTarget("mailto:Someone <someone@example.com>"), "invalid")
+	assert.ErrorContains(t, c.parseNotifyTarget("mailto:<someone@example.com>"), "invalid")
+
+	// only allowed domains and addresses can be sent to
+	assert.NilError(t, c.parseNotifyTarget("mailto:Someone@EXAMPLE.com"))
+	assert.NilError(t, c.parseNotifyTarget("mailto:ops@example.org"))
+	assert.ErrorContains(t, c.parseNotifyTarget("mailto:someone@example.org"), "not allowed")
+	assert.ErrorContains(t, c.parseNotifyTarget("mailto:someone@sub.example.com"), "not allowed")
+
+	cfg := DefaultConfig()
+	cfg.NotifySmtpAddr = "localhost:25"
+	assert.ErrorContains(t, cfg.Validate(), "requires notify-mail-domains")
+	assert.ErrorContains(t, c.parseNotifyTarget("ftp://example.com"), "not supported")
+	assert.ErrorContains(t, c.parseNotifyTarget("http://example.com/hook"), "not supported")
+
+	c.NotifyWebhooks = false
+	assert.ErrorContains(t, c.parseNotifyTarget("https://example.com/hook"), "disabled")
+}
+
+func TestNotifyClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected notification")
+	}))
+	defer server.Close()
+
+	n := &notifier{client: newNotifyClient()}
+	err := n.post(context.Background(), server.URL, []byte("{}"))
+	assert.ErrorContains(t, err, "is not public")
+
+	for _, addr := range []string{
+		"10.0.0.1:443",
+		"169.254.169.254:80",
+		"100.64.0.1:443",
+		"192.0.0.170:443",
+		"198.18.0.1:443",
+		"203.0.113.7:443",
+		"[::1]:443",
+		"[::ffff:192.168.0.1]:443",
+		"[64:ff9b::a9fe:a9fe]:80",
+		"[2002:a00:1::1]:443",
+		"[2001:db8::1]:443",
+	} {
+		assert.ErrorContains(t, checkNotifyAddr("tcp", addr, nil), "is not public", addr)
+	}
+	for _, addr := range []string{"8.8.8.8:443", "[2606:4700::1111]:443", "[64:ff9b::808:808]:443", "[2002:808:808::1]:443"} {
+		assert.NilError(t, checkNotifyAddr("tcp", addr, nil), addr)
+	}
+}
+
+func TestSqliteNotifyRetrieved(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	notify, target, received := testNotifier(t)
+
+	ctx := context.Background()
+	store := sqliteStore{db: db, now: clock, notify: notify}
+	defer store.Close()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+		Notify: target,
+	})
+	assert.NilError(t, err)
+
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+
+	event := <-received
+	assert.Equal(t, notifyRetrieved, event.Event)
+
+	// retrieved secrets are not reported as expired
+	store.expireSecrets(ctx, now.Add(2*time.Hour))
+	select {
+	case event = <-received:
+		t.Fatalf("unexpected %s notification", event.Event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSqliteNotifyExpired(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	notify, target, received := testNotifier(t)
+
+	ctx := context.Background()
+	store := sqliteStore{db: db, now: clock, notify: notify}
+	defer store.Close()
+
+	_, err = store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+		Notify: target,
+	})
+	assert.NilError(t, err)
+
+	store.expireSecrets(ctx, now.Add(2*time.Hour))
+
+	event := <-received
+	assert.Equal(t, notifyExpired, event.Event)
+}
+
+func TestRedisNotifyExpired(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NilError(t, err)
+	defer mr.Close()
+
+	pool := &redis.Pool{
+		MaxIdle:      3,
+		IdleTimeout:  time.Minute,
+		Dial:         func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) },
+		TestOnBorrow: redisTestFunc,
+	}
+	notify, target, received := testNotifier(t)
+
+	ctx := context.Background()
+	store := &redisStore{cfg: testConfig(), db: pool, now: time.Now, notify: notify}
+	defer store.Close()
+
+	retrievedKey, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+		Notify: target,
+	})
+	assert.NilError(t, err)
+
+	_, err = store.Put(ctx, &SecretWithTTL{
+		Secret: "wobble",
+		TTL:    time.Hour,
+		Notify: target,
+	})
+	assert.NilError(t, err)
+
+	secret, err := store.Take(ctx, retrievedKey)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+
+	event := <-received
+	assert.Equal(t, notifyRetrieved, event.Event)
+
+	mr.FastForward(2 * time.Hour)
+	store.expireSecrets(ctx, time.Now().Add(2*time.Hour))
+
+	event = <-received
+	assert.Equal(t, notifyExpired, event.Event)
+}
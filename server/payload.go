@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Payload references have the form "gfs3:<object name>", and
+// object names have the form "<prefix><expiry>/<id>", with a
+// zero-padded expiry so that objects are listed in expiry order.
+// The id is the hash of the secret key when the key is known, so
+// that rekey can bind sealed objects to their keys, or else random.
+const payloadPrefix = "gfs3:"
+
+// payloadStore keeps large secret values as objects in an S3-compatible
+// bucket, and only a reference to each object in the backend, so that the
+// backend still decides when a secret can be taken, revoked, or expires.
+type payloadStore struct {
+	Store
+	cfg    *config
+	bucket *minio.Client
+	now    func() time.Time
+}
+
+func (c *config) newPayloadStore(ctx context.Context, store Store) (Store, error) {
+	client, err := c.openBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Using S3 payload store", "endpoint", c.S3Endpoint, "bucket", c.S3Bucket, "min_bytes", c.S3MinBytes)
+	p := &payloadStore{Store: store, cfg: c, bucket: client, now: time.Now}
+	go p.regularSweep(ctx)
+	return p, nil
+}
+
+// rekeyPayloads re-encrypts the objects of large secrets, whose
+// backend values are only references that are never sealed.
+func (c *config) rekeyPayloads(ctx context.Context, keys KeyProvider) (int, error) {
+	client, err := c.openBucket(ctx)
+	if err != nil {
+		return 0, err
+	}
+	p := &payloadStore{cfg: c, bucket: client, now: time.Now}
+	return p.rekey(ctx, keys)
+}
+
+func (c *config) openBucket(ctx context.Context) (*minio.Client, error) {
+	client, err := c.newS3Client()
+	if err != nil {
+		return nil, err
+	}
+	found, err := client.BucketExists(ctx, c.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("s3 bucket check failed: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("s3 bucket %q does not exist", c.S3Bucket)
+	}
+	return client, nil
+}
+
+func (c *config) newS3Client() (*minio.Client, error) {
+	endpoint, err := url.Parse(c.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "https" && endpoint.Scheme != "http" {
+		return nil, fmt.Errorf("s3 endpoint %q must be an http or https url", c.S3Endpoint)
+	}
+	return minio.New(endpoint.Host, &minio.Options{
+		Creds:  credentials.New(&s3Credentials{cfg: c}),
+		Secure: endpoint.Scheme == "https",
+		Region: c.S3Region,
+	})
+}
+
+// s3Credentials reads the keys on every request,
+// so that a reloaded secret key is used at once.
+type s3Credentials struct {
+	cfg *config
+}
+
+func (s *s3Credentials) Retrieve() (credentials.Value, error) {
+	return credentials.Value{
+		AccessKeyID:     s.cfg.credential(&s.cfg.S3AccessKey),
+		SecretAccessKey: s.cfg.credential(&s.cfg.S3SecretKey),
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func (s *s3Credentials) RetrieveWithCredContext(*credentials.CredContext) (credentials.Value, error) {
+	return s.Retrieve()
+}
+
+func (s *s3Credentials) IsExpired() bool {
+	return true
+}
+
+func (p *payloadStore) objectName(expireAt time.Time, key string) string {
+	id := NewSecretKey()
+	if key != "" {
+		id = hashValue(key)
+	}
+	return fmt.Sprintf("%s%020d/%s", p.cfg.S3Prefix, expireAt.Unix(), id)
+}
+
+// objectKeyHash is empty for objects with random ids.
+func (p *payloadStore) objectKeyHash(name string) string {
+	_, id, _ := strings.Cut(strings.TrimPrefix(name, p.cfg.S3Prefix), "/")
+	if len(id) != sha256.Size*2 {
+		return ""
+	}
+	return id
+}
+
+func (p *payloadStore) objectExpiry(name string) (int64, error) {
+	expiry, _, found := strings.Cut(strings.TrimPrefix(name, p.cfg.S3Prefix), "/")
+	if !found {
+		return 0, fmt.Errorf("invalid payload object name %q", name)
+	}
+	return strconv.ParseInt(expiry, 10, 64)
+}
+
+func (p *payloadStore) Put(ctx context.Context, req *SecretWithTTL) (string, error) {
+	if len(req.Secret) < p.cfg.S3MinBytes {
+		return p.Store.Put(ctx, req)
+	}
+	name := p.objectName(p.now().Add(req.TTL), req.Key)
+	payload := strings.NewReader(req.Secret)
+	_, err := p.bucket.PutObject(ctx, p.cfg.S3Bucket, name, payload, payload.Size(), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return "", err
+	}
+	clone := *req
+	clone.Secret = payloadPrefix + name
+	key, err := p.Store.Put(ctx, &clone)
+	if err != nil {
+		p.removeObject(name)
+	}
+	return key, err
+}
+
+// Take reads the object of a secret before the backend takes the secret,
+// so that a secret is not lost when its object cannot be read. Objects
+// are only read afterwards for backends that do not peek at references.
+func (p *payloadStore) Take(ctx context.Context, key string) (string, error) {
+	peeked, payload, err := p.peekObject(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	value, err := p.Store.Take(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	name, ok := strings.CutPrefix(value, payloadPrefix)
+	if !ok {
+		return value, nil // small enough to stay in the backend
+	}
+	if name != peeked {
+		payload, _, err = p.readObject(ctx, name)
+		if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+			return "", ErrNotFound
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	p.removeObject(name)
+	return payload, nil
+}
+
+// peekObject leaves any secret that cannot be peeked at,
+// or whose object is missing, for the backend to report.
+func (p *payloadStore) peekObject(ctx context.Context, key string) (string, string, error) {
+	peek, err := p.Store.Peek(ctx, key)
+	if err != nil || peek.payload == "" {
+		return "", "", nil
+	}
+	name := strings.TrimPrefix(peek.payload, payloadPrefix)
+	payload, _, err := p.readObject(ctx, name)
+	if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return name, payload, nil
+}
+
+// Delete removes the objects of revoked secrets at once, rather than
+// leaving them to the sweep, when the backend reports their references.
+func (p *payloadStore) Delete(ctx context.Context, token string) (*SecretStatus, error) {
+	status, err := p.Store.Delete(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := strings.CutPrefix(status.payload, payloadPrefix); ok {
+		p.removeObject(name)
+	}
+	return status, nil
+}
+
+// payloadRef returns the value of a secret if it is a payload
+// reference, so that other values are not copied from a backend.
+func payloadRef(value string) string {
+	if strings.HasPrefix(value, payloadPrefix) {
+		return value
+	}
+	return ""
+}
+
+// removeObject leaves objects that cannot be removed
+// to the sweep, which removes them once they expire.
+func (p *payloadStore) removeObject(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.bucket.RemoveObject(ctx, p.cfg.S3Bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		log.Warn("failed to remove payload", "err", err)
+	}
+}
+
+func (p *payloadStore) regularSweep(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.S3Sweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if count, err := p.sweep(ctx, now); err != nil {
+				log.Warn("payload sweep failed", "err", err)
+			} else if count > 0 {
+				log.Info("Removed expired payloads", "count", count)
+			}
+		}
+	}
+}
+
+// sweep removes the objects of secrets that expired, or were revoked,
+// before they were taken, and stops at the first unexpired object.
+func (p *payloadStore) sweep(ctx context.Context, now time.Time) (int, error) {
+	var count int
+	var problems []error
+	objects := p.bucket.ListObjectsIter(ctx, p.cfg.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    p.cfg.S3Prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return count, object.Err
+		}
+		expireAt, err := p.objectExpiry(object.Key)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if expireAt > now.Unix() {
+			break
+		}
+		err = p.bucket.RemoveObject(ctx, p.cfg.S3Bucket, object.Key, minio.RemoveObjectOptions{})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, errors.Join(problems...)
+}
+
+// rekey rewrites objects only if they are unchanged since they
+// were read, so that objects taken meanwhile are not recreated.
+func (p *payloadStore) rekey(ctx context.Context, keys KeyProvider) (int, error) {
+	var count int
+	objects := p.bucket.ListObjectsIter(ctx, p.cfg.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    p.cfg.S3Prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return count, object.Err
+		}
+		value, etag, err := p.readObject(ctx, object.Key)
+		if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+			continue // taken since it was listed
+		}
+		if err != nil {
+			return count, err
+		}
+		keyHash := p.objectKeyHash(object.Key)
+		if !needsRekey(keys, value, keyHash) {
+			continue
+		}
+		sealed, err := resealValue(ctx, keys, value, keyHash)
+		if err != nil {
+			return count, err
+		}
+		opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+		opts.SetMatchETag(etag)
+		payload := strings.NewReader(sealed)
+		_, err = p.bucket.PutObject(ctx, p.cfg.S3Bucket, object.Key, payload, payload.Size(), opts)
+		switch minio.ToErrorResponse(err).Code {
+		case "":
+			count++
+		case minio.NoSuchKey, "PreconditionFailed":
+			// taken since it was read
+		default:
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (p *payloadStore) readObject(ctx context.Context, name string) (string, string, error) {
+	object, err := p.bucket.GetObject(ctx, p.cfg.S3Bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	defer object.Close()
+	info, err := object.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	var payload bytes.Buffer
+	if _, err = io.Copy(&payload, object); err != nil {
+		return "", "", err
+	}
+	return payload.String(), info.ETag, nil
+}
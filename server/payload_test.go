@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"gotest.tools/v3/assert"
+)
+
+// testBucket fails reads of objects while its result is set.
+func testBucket(t *testing.T, cfg *config) *atomic.Bool {
+	backend := s3mem.New()
+	assert.NilError(t, backend.CreateBucket("secrets"))
+	handler := gofakes3.New(backend).Server()
+	failReads := new(atomic.Bool)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failReads.Load() && r.Method == http.MethodGet && strings.Count(r.URL.Path, "/") > 1 {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(fake.Close)
+	cfg.S3Endpoint = fake.URL
+	cfg.S3Bucket = "secrets"
+	cfg.S3AccessKey = "access"
+	cfg.S3SecretKey = "secret"
+	return failReads
+}
+
+func testPayloadStore(t *testing.T, minBytes int) (*payloadStore, *memoryStore, *time.Time) {
+	cfg := testConfig()
+	cfg.S3MinBytes = minBytes
+	testBucket(t, cfg)
+	backend, now := testMemoryStore(t, 0)
+	store, err := cfg.newPayloadStore(t.Context(), backend)
+	assert.NilError(t, err)
+	payloads := store.(*payloadStore)
+	payloads.now = backend.now
+	return payloads, backend, now
+}
+
+func (p *payloadStore) testObjects(t *testing.T) []string {
+	var names []string
+	for object := range p.bucket.ListObjectsIter(t.Context(), p.cfg.S3Bucket, minio.ListObjectsOptions{Recursive: true}) {
+		assert.NilError(t, object.Err)
+		names = append(names, object.Key)
+	}
+	return names
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	store, backend, _ := testPayloadStore(t, 16)
+	ctx := context.Background()
+
+	large := strings.Repeat("wibble", 1000)
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: large, TTL: time.Hour})
+	assert.NilError(t, err)
+
+	// only the reference is kept in the backend
+	objects := store.testObjects(t)
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, payloadPrefix+objects[0], string(backend.secrets[key].value))
+
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, large, secret)
+	assert.Equal(t, 0, len(store.testObjects(t)))
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestPayloadFailedRead(t *testing.T) {
+	cfg := testConfig()
+	cfg.S3MinBytes = 16
+	failReads := testBucket(t, cfg)
+	backend, _ := testMemoryStore(t, 0)
+	store, err := cfg.newPayloadStore(t.Context(), backend)
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	large := strings.Repeat("wibble", 1000)
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: large, TTL: time.Hour})
+	assert.NilError(t, err)
+
+	failReads.Store(true)
+	_, err = store.Take(ctx, key)
+	assert.ErrorContains(t, err, "Access Denied")
+
+	// the secret can still be taken once its object can be read
+	failReads.Store(false)
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, large, secret)
+}
+
+func TestPayloadSmallSecret(t *testing.T) {
+	store, _, _ := testPayloadStore(t, 16)
+	ctx := context.Background()
+
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(store.testObjects(t)))
+
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
+
+func TestPayloadDelete(t *testing.T) {
+	store, _, _ := testPayloadStore(t, 16)
+	ctx := context.Background()
+
+	token := NewSecretKey()
+	_, err := store.Put(ctx, &SecretWithTTL{Secret: strings.Repeat("wibble", 1000), TTL: time.Hour, Token: token})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(store.testObjects(t)))
+
+	// revoked objects are not left for the sweep
+	status, err := store.Delete(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusRevoked, status.State)
+	assert.Equal(t, 0, len(store.testObjects(t)))
+}
+
+func TestPayloadSweep(t *testing.T) {
+	store, _, now := testPayloadStore(t, 0)
+	ctx := context.Background()
+
+	_, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	_, err = store.Put(ctx, &SecretWithTTL{Secret: "wobble", TTL: 3 * time.Hour})
+	assert.NilError(t, err)
+
+	count, err := store.sweep(ctx, *now)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = store.sweep(ctx, now.Add(2*time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 1, len(store.testObjects(t)))
+}
+
+func TestPayloadRekey(t *testing.T) {
+	payloads, _, _ := testPayloadStore(t, 16)
+	ctx := context.Background()
+
+	oldEntry := testKeyEntry("old")
+	oldKeys, err := parseFileKeys([]string{oldEntry})
+	assert.NilError(t, err)
+	store := &sealedStore{Store: payloads, keys: oldKeys}
+
+	large := strings.Repeat("wibble", 1000)
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: large, TTL: time.Hour})
+	assert.NilError(t, err)
+
+	newEntry := testKeyEntry("new")
+	rotated, err := parseFileKeys([]string{newEntry, oldEntry})
+	assert.NilError(t, err)
+	count, err := payloads.rekey(ctx, rotated)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, count)
+
+	// the old key is no longer needed
+	store.keys, err = parseFileKeys([]string{newEntry})
+	assert.NilError(t, err)
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, large, secret)
+}
+
+func TestPayloadMissingBucket(t *testing.T) {
+	cfg := testConfig()
+	testBucket(t, cfg)
+	cfg.S3Bucket = "missing"
+	backend, _ := testMemoryStore(t, 0)
+	_, err := cfg.newPayloadStore(t.Context(), backend)
+	assert.ErrorContains(t, err, `s3 bucket "missing" does not exist`)
+}
+
+func TestNewServer_PayloadMaxBytes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backend = MemoryBackend
+	cfg.LimitCount = 0
+	c := newConfig(cfg)
+	testBucket(t, c)
+
+	srv, err := NewServer(c.Config)
+	assert.NilError(t, err)
+	defer srv.Close()
+
+	large := strings.Repeat("wibble", 1000)
+	res := testPost(t, srv, "/push", url.Values{"secret": {large}, "ttl": {"1"}})
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = testPost(t, srv, "/pull", url.Values{"key": {res.Body.String()}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, large, res.Body.String())
+}
@@ -0,0 +1,843 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// Notification targets are kept beyond the expiry of their
+	// secrets so that they can still be found by expiry polling.
+	redisNotifyGrace = 24 * time.Hour
+	redisExpiryBatch = 1000
+)
+
+// Ways to take a value from Redis in one atomic step, since GETDEL
+// needs Redis 6.2, and some managed servers do not allow scripts.
+const (
+	redisGetDelCommand = "getdel"
+	redisGetDelScript  = "lua"
+	redisGetDelMulti   = "multi"
+)
+
+var redisGetDelLua = redis.NewScript(1, `
+local value = redis.call('GET', KEYS[1])
+if value then
+    redis.call('DEL', KEYS[1])
+end
+return value
+`)
+
+type redisStore struct {
+	cfg    *config
+	db     redisPool
+	now    func() time.Time
+	audit  *auditLog
+	notify *notifier
+
+	// getDel is empty until the server has been probed
+	getDelMu sync.Mutex
+	getDel   string
+}
+
+func (c *config) newRedisStore(ctx context.Context, audit *auditLog, notify *notifier) (Store, error) {
+	pool, err := c.newRedisPool()
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Using Redis secret store", "addr", c.RedisAddr, "mode", c.RedisMode, "tls", c.RedisTLS)
+	store := &redisStore{
+		cfg:    c,
+		db:     pool,
+		now:    time.Now,
+		audit:  audit,
+		notify: notify,
+	}
+	if _, err = store.getDelMode(ctx); err != nil {
+		log.Warn("Redis get and delete will be detected on first use", "err", err)
+	}
+	go store.regularExpiryPolling(ctx)
+	return store, nil
+}
+
+// newRedisPool expects a Redis url to have been resolved by loadConfig.
+func (c *config) newRedisPool() (redisPool, error) {
+	// fail at startup rather than on first use
+	if _, err := c.redisTLS(); err != nil {
+		return nil, err
+	}
+	if c.redisNet == redisUnixScheme && c.RedisMode != RedisModeStandalone {
+		return nil, fmt.Errorf("redis %s mode cannot use a unix socket", c.RedisMode)
+	}
+	switch c.RedisMode {
+	case RedisModeStandalone:
+		return c.newRedisConnPool(c.redisDialFunc, redisTestFunc), nil
+	case RedisModeSentinel:
+		return c.newRedisConnPool(c.redisSentinelDialFunc, redisMasterTestFunc), nil
+	case RedisModeCluster:
+		if c.RedisDB > 0 {
+			return nil, errors.New("redis cluster only supports db 0")
+		}
+		return c.newRedisCluster(c.redisAddrs(), c.redisDial), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q", c.RedisMode)
+	}
+}
+
+func (c *config) newRedisConnPool(dial func() (redis.Conn, error), test func(redis.Conn, time.Time) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:      c.RedisMaxIdle,
+		MaxActive:    c.RedisMaxActive,
+		Wait:         c.RedisWait,
+		IdleTimeout:  c.RedisIdleTimeout,
+		Dial:         dial,
+		TestOnBorrow: test,
+	}
+}
+
+func (r *redisStore) Close() error {
+	return r.db.Close()
+}
+
+func (r *redisStore) Put(ctx context.Context, req *SecretWithTTL) (string, error) {
+	secret := &storedSecret{
+		key:       req.newKey(),
+		value:     req.Secret,
+		expireAt:  r.now().Add(req.TTL),
+		notify:    req.Notify,
+		notBefore: req.NotBefore,
+		cidrs:     formatCIDRs(req.AllowedCIDRs),
+	}
+	if req.Token != "" {
+		secret.manageHash = hashValue(req.Token)
+	}
+	return secret.key, r.put(ctx, secret, req.TTL)
+}
+
+func (r *redisStore) put(ctx context.Context, secret *storedSecret, remaining time.Duration) error {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	secretKey := secret.key
+	ttl := int64(remaining.Seconds())
+	expireAt := secret.expireAt.Unix()
+	if secret.notify != "" {
+		notifyTTL := ttl + int64(redisNotifyGrace.Seconds())
+		_, err := redis.DoContext(conn, ctx, "SET", r.cfg.redisKey("n", secretKey), secret.notify, "EX", notifyTTL)
+		if err != nil {
+			return err
+		}
+	}
+	if secret.manageHash != "" {
+		receipt := r.cfg.redisKey("m", secret.manageHash)
+		_, err := redis.DoContext(conn, ctx, "HSET", receipt, "key", secretKey, "state", StatusPending, "expire_at", expireAt)
+		if err != nil {
+			return err
+		}
+		_, err = redis.DoContext(conn, ctx, "EXPIRE", receipt, ttl+int64(statusRetention.Seconds()))
+		if err != nil {
+			return err
+		}
+		_, err = redis.DoContext(conn, ctx, "SET", r.cfg.redisKey("t", secretKey), secret.manageHash, "EX", ttl)
+		if err != nil {
+			return err
+		}
+	}
+	if !secret.notBefore.IsZero() {
+		_, err := redis.DoContext(conn, ctx, "SET", r.cfg.redisKey("b", secretKey), secret.notBefore.Unix(), "EX", ttl)
+		if err != nil {
+			return err
+		}
+	}
+	if secret.cidrs != "" {
+		_, err := redis.DoContext(conn, ctx, "SET", r.cfg.redisKey("c", secretKey), secret.cidrs, "EX", ttl)
+		if err != nil {
+			return err
+		}
+	}
+	// the expiry index lets us detect secrets that expired unread
+	_, err := redis.DoContext(conn, ctx, "ZADD", r.cfg.redisKey("x", "expiry"), expireAt, secretKey)
+	if err != nil {
+		return err
+	}
+	_, err = redis.DoContext(conn, ctx, "SET", r.cfg.redisKey("s", secretKey), secret.value, "EX", ttl)
+	return err
+}
+
+func (r *redisStore) Take(ctx context.Context, secretKey string) (string, error) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	// not-before times never change, so they can be checked first
+	notBefore, err := r.notBefore(ctx, conn, secretKey)
+	if err != nil {
+		return "", err
+	}
+	if notBefore.After(r.now()) {
+		return "", &LockedError{NotBefore: notBefore}
+	}
+	secret, err := redis.String(r.takeValue(ctx, conn, r.cfg.redisKey("s", secretKey)))
+	if err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return "", r.missing(ctx, conn, secretKey)
+		}
+		return "", err
+	}
+	index := r.cfg.redisKey("x", "expiry")
+	expireAt, err := redis.Int64(redis.DoContext(conn, ctx, "ZSCORE", index, secretKey))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		log.Warn("failed to fetch expiry", "err", err)
+	}
+	_, err = redis.DoContext(conn, ctx, "ZREM", index, secretKey)
+	if err != nil {
+		log.Warn("failed to remove expiry", "err", err)
+	}
+	if target := r.takeNotifyTarget(ctx, conn, secretKey); target != "" {
+		r.notify.send(target, &notifyEvent{Event: notifyRetrieved, Time: r.now().UTC(), ExpireAt: time.Unix(expireAt, 0).UTC()})
+	}
+	for _, key := range []string{r.cfg.redisKey("b", secretKey), r.cfg.redisKey("c", secretKey)} {
+		if _, err = redis.DoContext(conn, ctx, "DEL", key); err != nil {
+			log.Warn("failed to delete", "err", err)
+		}
+	}
+	manageHash, err := redis.String(r.takeValue(ctx, conn, r.cfg.redisKey("t", secretKey)))
+	if err == nil {
+		_, err = redis.DoContext(conn, ctx, "HSET", r.cfg.redisKey("m", manageHash), "state", StatusRetrieved)
+	}
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		log.Warn("failed to update receipt", "err", err)
+	}
+	return secret, nil
+}
+
+func (r *redisStore) Peek(ctx context.Context, secretKey string) (*SecretPeek, error) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int64(redis.DoContext(conn, ctx, "PTTL", r.cfg.redisKey("s", secretKey)))
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 0 {
+		return nil, r.missing(ctx, conn, secretKey)
+	}
+	notBefore, err := r.notBefore(ctx, conn, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	cidrs, err := redis.String(redis.DoContext(conn, ctx, "GET", r.cfg.redisKey("c", secretKey)))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return nil, err
+	}
+	allowed, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	value, err := redis.String(redis.DoContext(conn, ctx, "GET", r.cfg.redisKey("s", secretKey)))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return nil, err
+	}
+	return &SecretPeek{
+		Exists:       true,
+		ExpireAt:     r.now().Add(time.Duration(ttl) * time.Millisecond).Truncate(time.Second).UTC(),
+		NotBefore:    notBefore,
+		AllowedCIDRs: allowed,
+		payload:      payloadRef(value),
+	}, nil
+}
+
+// notBefore is zero for secrets that can be taken at once.
+func (r *redisStore) notBefore(ctx context.Context, conn redis.Conn, secretKey string) (time.Time, error) {
+	unix, err := redis.Int64(redis.DoContext(conn, ctx, "GET", r.cfg.redisKey("b", secretKey)))
+	if errors.Is(err, redis.ErrNil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0).UTC(), nil
+}
+
+// getDelMode probes the server until it can be reached, so that a
+// server that is down at startup is not mistaken for a newer one.
+func (r *redisStore) getDelMode(ctx context.Context) (string, error) {
+	r.getDelMu.Lock()
+	defer r.getDelMu.Unlock()
+	if r.getDel != "" {
+		return r.getDel, nil
+	}
+	mode, err := r.detectGetDel(ctx)
+	if err != nil {
+		return "", fmt.Errorf("redis get and delete detection failed: %w", err)
+	}
+	log.Info("Using Redis get and delete", "mode", mode)
+	r.getDel = mode
+	return mode, nil
+}
+
+// detectGetDel probes the server with a key that is never set, and
+// only falls back when the server rejects a command, rather than
+// when it cannot be reached.
+func (r *redisStore) detectGetDel(ctx context.Context) (string, error) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	probe := r.cfg.redisKey("x", "probe")
+	var rejected redis.Error
+	_, err := redis.DoContext(conn, ctx, "GETDEL", probe)
+	if err == nil {
+		return redisGetDelCommand, nil
+	}
+	if !errors.As(err, &rejected) {
+		return "", err
+	}
+	_, err = redisGetDelLua.DoContext(ctx, conn, probe)
+	if err == nil {
+		return redisGetDelScript, nil
+	}
+	if !errors.As(err, &rejected) {
+		return "", err
+	}
+	return redisGetDelMulti, nil
+}
+
+// takeValue gets and deletes a key, with a nil reply when it does not exist.
+func (r *redisStore) takeValue(ctx context.Context, conn redis.Conn, key string) (any, error) {
+	getDel, err := r.getDelMode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch getDel {
+	case redisGetDelScript:
+		return redisGetDelLua.DoContext(ctx, conn, key)
+	case redisGetDelMulti:
+		if err := conn.Send("MULTI"); err != nil {
+			return nil, err
+		}
+		if err := conn.Send("GET", key); err != nil {
+			return nil, err
+		}
+		if err := conn.Send("DEL", key); err != nil {
+			return nil, err
+		}
+		values, err := redis.Values(redis.DoContext(conn, ctx, "EXEC"))
+		if err != nil {
+			return nil, err
+		}
+		return values[0], nil
+	default:
+		return redis.DoContext(conn, ctx, "GETDEL", key)
+	}
+}
+
+func (r *redisStore) Status(ctx context.Context, token string) (*SecretStatus, error) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	_, status, err := r.receipt(ctx, conn, hashValue(token))
+	return status, err
+}
+
+// missing tells apart secrets that expired unread, which stay in
+// the expiry index until they are polled, from unknown secrets.
+func (r *redisStore) missing(ctx context.Context, conn redis.Conn, secretKey string) error {
+	expireAt, err := redis.Int64(redis.DoContext(conn, ctx, "ZSCORE", r.cfg.redisKey("x", "expiry"), secretKey))
+	if errors.Is(err, redis.ErrNil) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if expireAt <= r.now().Unix() {
+		return ErrExpired
+	}
+	return ErrNotFound
+}
+
+func (r *redisStore) Stats(ctx context.Context) (*Stats, error) {
+	stats := &Stats{}
+	err := r.scanKeys(ctx, r.cfg.redisKey("s", "*"), func(string) error {
+		stats.Secrets++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn := r.db.Get()
+	defer conn.Close()
+
+	// taken and deleted secrets are no longer in the expiry index
+	index := r.cfg.redisKey("x", "expiry")
+	after := fmt.Sprintf("(%d", r.now().Unix())
+	oldest, err := redis.Int64Map(redis.DoContext(conn, ctx, "ZRANGEBYSCORE", index, after, "+inf", "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	newest, err := redis.Int64Map(redis.DoContext(conn, ctx, "ZREVRANGEBYSCORE", index, "+inf", after, "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	for _, expireAt := range oldest {
+		stats.OldestExpireAt = time.Unix(expireAt, 0).UTC()
+	}
+	for _, expireAt := range newest {
+		stats.NewestExpireAt = time.Unix(expireAt, 0).UTC()
+	}
+	return stats, nil
+}
+
+func (r *redisStore) Delete(ctx context.Context, token string) (*SecretStatus, error) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	manageHash := hashValue(token)
+	secretKey, status, err := r.receipt(ctx, conn, manageHash)
+	if err != nil || status.State != StatusPending {
+		return status, err
+	}
+	value, err := redis.String(r.takeValue(ctx, conn, r.cfg.redisKey("s", secretKey)))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return nil, err
+	}
+	if errors.Is(err, redis.ErrNil) {
+		// retrieved or expired since we last looked
+		_, status, err = r.receipt(ctx, conn, manageHash)
+		return status, err
+	}
+	_, err = redis.DoContext(conn, ctx, "HSET", r.cfg.redisKey("m", manageHash), "state", StatusRevoked)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{r.cfg.redisKey("t", secretKey), r.cfg.redisKey("n", secretKey), r.cfg.redisKey("b", secretKey), r.cfg.redisKey("c", secretKey)} {
+		if _, err = redis.DoContext(conn, ctx, "DEL", key); err != nil {
+			log.Warn("failed to delete", "err", err)
+		}
+	}
+	if _, err = redis.DoContext(conn, ctx, "ZREM", r.cfg.redisKey("x", "expiry"), secretKey); err != nil {
+		log.Warn("failed to remove expiry", "err", err)
+	}
+	event := newAuditEvent(auditBurned, secretKey)
+	event.ExpireAt = status.ExpireAt
+	r.audit.record(event)
+	status.State = StatusRevoked
+	status.payload = payloadRef(value)
+	return status, nil
+}
+
+func (r *redisStore) rekey(ctx context.Context, keys KeyProvider) (int, error) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	var count int
+	err := r.scanKeys(ctx, r.cfg.redisKey("s", "*"), func(name string) error {
+		value, err := redis.String(redis.DoContext(conn, ctx, "GET", name))
+		if errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		keyHash := hashValue(r.cfg.redisKeyID("s", name))
+		if !needsRekey(keys, value, keyHash) {
+			return nil
+		}
+		sealed, err := resealValue(ctx, keys, value, keyHash)
+		if err != nil {
+			return err
+		}
+		// retrieved secrets are not recreated
+		_, err = redis.String(redis.DoContext(conn, ctx, "SET", name, sealed, "XX", "KEEPTTL"))
+		if errors.Is(err, redis.ErrNil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// scanKeys visits matching keys on every node, since
+// each cluster node can only scan its own keys.
+func (r *redisStore) scanKeys(ctx context.Context, pattern string, fn func(name string) error) error {
+	nodes := []redisPool{r.db}
+	if cluster, ok := r.db.(*redisCluster); ok {
+		pools, err := cluster.masters()
+		if err != nil {
+			return err
+		}
+		nodes = nodes[:0]
+		for _, pool := range pools {
+			nodes = append(nodes, pool)
+		}
+	}
+	for _, node := range nodes {
+		if err := redisScan(ctx, node, pattern, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func redisScan(ctx context.Context, node redisPool, pattern string, fn func(name string) error) error {
+	conn := node.Get()
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		values, err := redis.Values(redis.DoContext(conn, ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var names []string
+		if _, err = redis.Scan(values, &cursor, &names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = fn(name); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (r *redisStore) receipt(ctx context.Context, conn redis.Conn, manageHash string) (string, *SecretStatus, error) {
+	values, err := redis.StringMap(redis.DoContext(conn, ctx, "HGETALL", r.cfg.redisKey("m", manageHash)))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(values) == 0 {
+		return "", nil, ErrNotFound
+	}
+	expireAt, err := strconv.ParseInt(values["expire_at"], 10, 64)
+	if err != nil {
+		return "", nil, err
+	}
+	status := &SecretStatus{
+		State:    values["state"],
+		ExpireAt: time.Unix(expireAt, 0).UTC(),
+	}
+	if status.State == StatusPending && !status.ExpireAt.After(r.now()) {
+		status.State = StatusExpired
+	}
+	return values["key"], status, nil
+}
+
+// takeNotifyTarget ensures that only one of retrieval or
+// expiry polling can claim the notification of a secret.
+func (r *redisStore) takeNotifyTarget(ctx context.Context, conn redis.Conn, secretKey string) string {
+	target, err := redis.String(r.takeValue(ctx, conn, r.cfg.redisKey("n", secretKey)))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		log.Warn("failed to fetch notification", "err", err)
+	}
+	return target
+}
+
+func (r *redisStore) regularExpiryPolling(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.NotifyPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.expireSecrets(ctx, now)
+		}
+	}
+}
+
+// expireSecrets finds secrets that were not retrieved before their
+// expiry, since retrieval removes secrets from the expiry index.
+func (r *redisStore) expireSecrets(ctx context.Context, now time.Time) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	index := r.cfg.redisKey("x", "expiry")
+	values, err := redis.Int64Map(redis.DoContext(conn, ctx, "ZRANGEBYSCORE", index, "-inf", now.Unix(), "WITHSCORES", "LIMIT", 0, redisExpiryBatch))
+	if err != nil {
+		log.Warn("expire secrets failed", "err", err)
+		return
+	}
+	for secretKey, expireAt := range values {
+		// claim the entry so that other instances do not report it as well
+		removed, err := redis.Int(redis.DoContext(conn, ctx, "ZREM", index, secretKey))
+		if err != nil {
+			log.Warn("expire secrets failed", "err", err)
+			return
+		}
+		if removed == 0 {
+			continue
+		}
+		event := newAuditEvent(auditExpired, secretKey)
+		event.ExpireAt = time.Unix(expireAt, 0).UTC()
+		r.audit.record(event)
+		if target := r.takeNotifyTarget(ctx, conn, secretKey); target != "" {
+			r.notify.send(target, &notifyEvent{Event: notifyExpired, Time: now.UTC(), ExpireAt: event.ExpireAt})
+		}
+	}
+}
+
+func (c *config) redisDialFunc() (redis.Conn, error) {
+	return c.redisDial(c.RedisAddr)
+}
+
+func (c *config) redisDial(addr string) (redis.Conn, error) {
+	opts, err := c.redisConnOptions()
+	if err != nil {
+		return nil, err
+	}
+	if user := c.credential(&c.RedisUser); user != "" {
+		opts = append(opts, redis.DialUsername(user))
+	}
+	if pass := c.credential(&c.RedisPass); pass != "" {
+		opts = append(opts, redis.DialPassword(pass))
+	}
+	if c.RedisDB > 0 {
+		opts = append(opts, redis.DialDatabase(c.RedisDB))
+	}
+	network := "tcp"
+	if c.redisNet != "" {
+		network = c.redisNet
+	}
+	return redis.Dial(network, addr, opts...)
+}
+
+func (c *config) redisConnOptions() ([]redis.DialOption, error) {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(c.RedisConnectTimeout),
+		redis.DialReadTimeout(c.RedisReadTimeout),
+		redis.DialWriteTimeout(c.RedisWriteTimeout),
+	}
+	tlsCfg, err := c.redisTLS()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(tlsCfg))
+	}
+	return opts, nil
+}
+
+// redisSentinelDialFunc asks the sentinels for the current master on
+// every dial, so that new connections follow a failover. Connections
+// to the previous master are then dropped by redisMasterTestFunc.
+func (c *config) redisSentinelDialFunc() (redis.Conn, error) {
+	addr, err := c.redisSentinelMaster()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.redisDial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = redisMasterTestFunc(conn, time.Now()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *config) redisSentinelMaster() (string, error) {
+	var errs []error
+	for _, sentinel := range c.redisAddrs() {
+		addr, err := c.redisAskSentinel(sentinel)
+		if err == nil {
+			return addr, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", sentinel, err))
+	}
+	return "", fmt.Errorf("cannot find redis master %q: %w", c.RedisSentinelMaster, errors.Join(errs...))
+}
+
+// Sentinels do not share the credentials or database
+// of the master, so they are dialled with TLS only.
+func (c *config) redisAskSentinel(sentinel string) (string, error) {
+	opts, err := c.redisConnOptions()
+	if err != nil {
+		return "", err
+	}
+	conn, err := redis.Dial("tcp", sentinel, opts...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	master, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", c.RedisSentinelMaster))
+	if err != nil {
+		return "", err
+	}
+	if len(master) != 2 {
+		return "", errors.New("unknown master")
+	}
+	return net.JoinHostPort(master[0], master[1]), nil
+}
+
+func (c *config) redisAddrs() []string {
+	var addrs []string
+	for addr := range strings.SplitSeq(c.RedisAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// redisTLS reads its files on every call, so that
+// new connections pick up renewed certificates.
+func (c *config) redisTLS() (*tls.Config, error) {
+	var cfg *tls.Config
+	switch c.RedisTLS {
+	case RedisTLSOn:
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	case RedisTLSInsecure:
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: true}
+	default:
+		if c.RedisCAFile != "" || c.RedisCertFile != "" || c.RedisKeyFile != "" || c.RedisServerName != "" {
+			return nil, errors.New("redis TLS options require redis TLS to be enabled")
+		}
+		return nil, nil
+	}
+	cfg.ServerName = c.RedisServerName
+	if c.RedisCAFile != "" {
+		pem, err := os.ReadFile(c.RedisCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.RedisCAFile)
+		}
+	}
+	if c.RedisCertFile != "" || c.RedisKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.RedisCertFile, c.RedisKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func redisTestFunc(c redis.Conn, _ time.Time) error {
+	_, err := c.Do("PING")
+	return err
+}
+
+func redisMasterTestFunc(c redis.Conn, _ time.Time) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("unexpected ROLE reply")
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return fmt.Errorf("redis node is a %s, not a master", name)
+	}
+	return nil
+}
+
+// redisKeyID returns the key that was given to redisKey for a redis key name.
+func (c *config) redisKeyID(prefix, name string) string {
+	key := strings.TrimPrefix(name, strings.TrimSuffix(c.redisKey(prefix, ""), "{}"))
+	return strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+}
+
+// redisKey uses hash tags in cluster mode so that all
+// keys that belong to one secret share a cluster slot.
+func (c *config) redisKey(prefix, key string) string {
+	if c.RedisMode == RedisModeCluster {
+		key = "{" + key + "}"
+	}
+	if c.RedisNS != "" {
+		return fmt.Sprintf("%s:%s:%s", c.RedisNS, prefix, key)
+	}
+	return fmt.Sprintf("%s:%s", prefix, key)
+}
+
+func (r *redisStore) exportSecrets(ctx context.Context, fn func(secret *storedSecret) error) error {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	return r.scanKeys(ctx, r.cfg.redisKey("s", "*"), func(name string) error {
+		secret := &storedSecret{key: r.cfg.redisKeyID("s", name)}
+		values, err := redis.Values(redis.DoContext(conn, ctx, "MGET", name, r.cfg.redisKey("n", secret.key), r.cfg.redisKey("t", secret.key), r.cfg.redisKey("b", secret.key), r.cfg.redisKey("c", secret.key)))
+		if err != nil {
+			return err
+		}
+		if values[0] == nil {
+			// taken since it was scanned
+			return nil
+		}
+		var notBefore int64
+		if _, err = redis.Scan(values, &secret.value, &secret.notify, &secret.manageHash, &notBefore, &secret.cidrs); err != nil {
+			return err
+		}
+		if notBefore > 0 {
+			secret.notBefore = time.Unix(notBefore, 0)
+		}
+		ttl, err := redis.Int64(redis.DoContext(conn, ctx, "PTTL", name))
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			return nil
+		}
+		secret.expireAt = r.now().Add(time.Duration(ttl) * time.Millisecond)
+		return fn(secret)
+	})
+}
+
+func (r *redisStore) importSecret(ctx context.Context, secret *storedSecret) error {
+	remaining := secret.expireAt.Sub(r.now())
+	if remaining < time.Second {
+		return ErrExpired
+	}
+	return r.put(ctx, secret, remaining)
+}
+
+func (r *redisStore) lookupSecret(ctx context.Context, key string) (string, error) {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	secret, err := redis.String(redis.DoContext(conn, ctx, "GET", r.cfg.redisKey("s", key)))
+	if errors.Is(err, redis.ErrNil) {
+		return "", ErrNotFound
+	}
+	return secret, err
+}
+
+func (r *redisStore) removeSecret(ctx context.Context, secret *storedSecret) error {
+	conn := r.db.Get()
+	defer conn.Close()
+
+	names := []string{r.cfg.redisKey("s", secret.key), r.cfg.redisKey("n", secret.key), r.cfg.redisKey("t", secret.key), r.cfg.redisKey("b", secret.key), r.cfg.redisKey("c", secret.key)}
+	if secret.manageHash != "" {
+		names = append(names, r.cfg.redisKey("m", secret.manageHash))
+	}
+	// keys of a secret can be on different cluster nodes
+	for _, name := range names {
+		if _, err := redis.DoContext(conn, ctx, "DEL", name); err != nil {
+			return err
+		}
+	}
+	_, err := redis.DoContext(conn, ctx, "ZREM", r.cfg.redisKey("x", "expiry"), secret.key)
+	return err
+}
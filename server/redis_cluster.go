@@ -0,0 +1,389 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	redisClusterSlots     = 16384
+	redisClusterRedirects = 3
+)
+
+// redisPool is satisfied by both a standalone
+// redis.Pool and by a redisCluster.
+type redisPool interface {
+	Get() redis.Conn
+	Close() error
+}
+
+// redisCluster routes each command to the node that serves the
+// slot of its key, and follows MOVED and ASK redirections when
+// slots migrate between nodes.
+type redisCluster struct {
+	cfg   *config
+	seeds []string
+	dial  func(addr string) (redis.Conn, error)
+
+	mu     sync.RWMutex
+	slots  [redisClusterSlots]string
+	pools  map[string]*redis.Pool
+	loaded bool
+	closed bool
+}
+
+func (c *config) newRedisCluster(seeds []string, dial func(addr string) (redis.Conn, error)) *redisCluster {
+	return &redisCluster{
+		cfg:   c,
+		seeds: seeds,
+		dial:  dial,
+		pools: make(map[string]*redis.Pool),
+	}
+}
+
+func (c *redisCluster) Get() redis.Conn {
+	return &redisClusterConn{cluster: c}
+}
+
+func (c *redisCluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var errs []error
+	for _, pool := range c.pools {
+		errs = append(errs, pool.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// masters returns the pools of all nodes that currently serve slots.
+func (c *redisCluster) masters() ([]*redis.Pool, error) {
+	if err := c.ensureSlots(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[string]bool)
+	var pools []*redis.Pool
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			pools = append(pools, c.poolLocked(addr))
+		}
+	}
+	return pools, nil
+}
+
+func (c *redisCluster) pool(addr string) *redis.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.poolLocked(addr)
+}
+
+func (c *redisCluster) poolLocked(addr string) *redis.Pool {
+	pool, ok := c.pools[addr]
+	if !ok {
+		pool = c.cfg.newRedisConnPool(func() (redis.Conn, error) { return c.dial(addr) }, redisTestFunc)
+		c.pools[addr] = pool
+	}
+	return pool
+}
+
+// addrForSlot returns the node for a slot, or any known node for a slot
+// of -1, which is used for commands that do not have a key.
+func (c *redisCluster) addrForSlot(slot int) (string, error) {
+	if err := c.ensureSlots(); err != nil {
+		return "", err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if slot >= 0 && c.slots[slot] != "" {
+		return c.slots[slot], nil
+	}
+	for _, addr := range c.slots {
+		if addr != "" {
+			return addr, nil
+		}
+	}
+	return "", errors.New("redis cluster has no known nodes")
+}
+
+func (c *redisCluster) ensureSlots() error {
+	c.mu.RLock()
+	loaded, closed := c.loaded, c.closed
+	c.mu.RUnlock()
+	if closed {
+		return errors.New("redis cluster is closed")
+	}
+	if loaded {
+		return nil
+	}
+	return c.refreshSlots()
+}
+
+// refreshSlots asks each known node in turn for the current slot layout.
+func (c *redisCluster) refreshSlots() error {
+	c.mu.RLock()
+	addrs := append([]string{}, c.seeds...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+
+	var errs []error
+	for _, addr := range addrs {
+		slots, err := c.fetchSlots(addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.loaded = true
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("cannot fetch redis cluster slots: %w", errors.Join(errs...))
+}
+
+func (c *redisCluster) fetchSlots(addr string) ([redisClusterSlots]string, error) {
+	var slots [redisClusterSlots]string
+	conn, err := c.dial(addr)
+	if err != nil {
+		return slots, err
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	for _, item := range ranges {
+		values, err := redis.Values(item, nil)
+		if err != nil || len(values) < 3 {
+			return slots, errors.New("unexpected CLUSTER SLOTS reply")
+		}
+		start, _ := redis.Int(values[0], nil)
+		end, _ := redis.Int(values[1], nil)
+		node, err := redis.Values(values[2], nil)
+		if err != nil || len(node) < 2 {
+			return slots, errors.New("unexpected CLUSTER SLOTS reply")
+		}
+		nodeHost, _ := redis.String(node[0], nil)
+		nodePort, _ := redis.Int(node[1], nil)
+		if nodeHost == "" {
+			nodeHost = host // same host as the node that we asked
+		}
+		nodeAddr := net.JoinHostPort(nodeHost, strconv.Itoa(nodePort))
+		for slot := start; slot <= end && slot < redisClusterSlots; slot++ {
+			slots[slot] = nodeAddr
+		}
+	}
+	return slots, nil
+}
+
+func (c *redisCluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slot >= 0 && slot < redisClusterSlots {
+		c.slots[slot] = addr
+	}
+}
+
+// redisClusterConn routes each command separately, except for pipelines,
+// which stay on the node of the first pipelined key until all replies
+// have been received. It does not hold any node connections when idle.
+type redisClusterConn struct {
+	cluster *redisCluster
+	bound   redis.Conn
+	pending int
+	err     error
+	// MULTI has no key, so it waits for the first queued command
+	multi bool
+}
+
+func (c *redisClusterConn) Close() error {
+	c.release()
+	return nil
+}
+
+func (c *redisClusterConn) Err() error {
+	if c.bound != nil {
+		return c.bound.Err()
+	}
+	return c.err
+}
+
+func (c *redisClusterConn) Do(cmd string, args ...any) (any, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *redisClusterConn) DoContext(ctx context.Context, cmd string, args ...any) (any, error) {
+	if c.bound != nil {
+		defer c.release()
+		return redis.DoContext(c.bound, ctx, cmd, args...)
+	}
+	slot := redisCommandSlot(cmd, args)
+	addr, err := c.cluster.addrForSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for range redisClusterRedirects {
+		reply, err := c.doOnNode(ctx, addr, asking, cmd, args)
+		var redisErr redis.Error
+		if !errors.As(err, &redisErr) {
+			return reply, err
+		}
+		kind, movedSlot, target, ok := parseRedisRedirect(string(redisErr))
+		if !ok {
+			return reply, err
+		}
+		if kind == "MOVED" {
+			c.cluster.moved(movedSlot, target)
+		}
+		addr, asking = target, kind == "ASK"
+	}
+	return nil, errors.New("too many redis cluster redirections")
+}
+
+func (c *redisClusterConn) doOnNode(ctx context.Context, addr string, asking bool, cmd string, args []any) (any, error) {
+	conn, err := c.cluster.pool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if asking {
+		if _, err = redis.DoContext(conn, ctx, "ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return redis.DoContext(conn, ctx, cmd, args...)
+}
+
+func (c *redisClusterConn) Send(cmd string, args ...any) error {
+	if c.bound == nil && strings.EqualFold(cmd, "MULTI") {
+		c.multi = true
+		return nil
+	}
+	if c.bound == nil {
+		addr, err := c.cluster.addrForSlot(redisCommandSlot(cmd, args))
+		if err != nil {
+			c.err = err
+			return err
+		}
+		c.bound = c.cluster.pool(addr).Get()
+		if c.multi {
+			c.multi = false
+			c.pending++
+			if err = c.bound.Send("MULTI"); err != nil {
+				return err
+			}
+		}
+	}
+	c.pending++
+	return c.bound.Send(cmd, args...)
+}
+
+func (c *redisClusterConn) Flush() error {
+	if c.bound == nil {
+		return c.err
+	}
+	return c.bound.Flush()
+}
+
+func (c *redisClusterConn) Receive() (any, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *redisClusterConn) ReceiveContext(ctx context.Context) (any, error) {
+	if c.bound == nil {
+		return nil, errors.New("redis cluster connection has no pending replies")
+	}
+	reply, err := redis.ReceiveContext(c.bound, ctx)
+	c.pending--
+	if c.pending <= 0 {
+		c.release()
+	}
+	return reply, err
+}
+
+func (c *redisClusterConn) release() {
+	if c.bound != nil {
+		c.bound.Close()
+		c.bound = nil
+	}
+	c.pending = 0
+	c.multi = false
+}
+
+func parseRedisRedirect(msg string) (kind string, slot int, addr string, ok bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+// redisCommandSlot returns the slot of the key of a command,
+// or -1 when the command does not have a key.
+func redisCommandSlot(cmd string, args []any) int {
+	var key any
+	switch strings.ToUpper(cmd) {
+	case "", "PING", "INFO", "ROLE", "SCAN", "SCRIPT", "CLUSTER", "ASKING":
+		return -1
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return -1
+		}
+		if n, err := strconv.Atoi(fmt.Sprint(args[1])); err != nil || n < 1 {
+			return -1
+		}
+		key = args[2]
+	default:
+		if len(args) == 0 {
+			return -1
+		}
+		key = args[0]
+	}
+	return redisKeySlot(fmt.Sprint(key))
+}
+
+// redisKeySlot only hashes the "{tag}" of keys that have one,
+// so that keys with the same tag are kept in the same slot.
+func redisKeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % redisClusterSlots)
+}
+
+// crc16 is the CRC-16/XMODEM checksum used for redis cluster slots.
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	mrserver "github.com/alicebob/miniredis/v2/server"
+	"github.com/gomodule/redigo/redis"
+	"gotest.tools/v3/assert"
+)
+
+func testRedisConfig(mode, addr string) *config {
+	c := testConfig()
+	c.Backend = RedisBackend
+	c.RedisMode, c.RedisAddr = mode, addr
+	return c
+}
+
+func TestRedisKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+	assert.Equal(t, 12182, redisKeySlot("foo"))
+	assert.Equal(t, redisKeySlot("user1000"), redisKeySlot("{user1000}.following"))
+	assert.Equal(t, redisKeySlot("{user1000}.followers"), redisKeySlot("{user1000}.following"))
+	assert.Equal(t, redisKeySlot("foo{}{bar}"), int(crc16("foo{}{bar}")%redisClusterSlots))
+
+	assert.Equal(t, redisKeySlot("s:{abc}"), redisCommandSlot("GETDEL", []any{"s:{abc}"}))
+	assert.Equal(t, redisKeySlot("h:{abc}"), redisCommandSlot("EVALSHA", []any{"sha", 1, "h:{abc}", "now"}))
+	assert.Equal(t, -1, redisCommandSlot("SCAN", []any{0}))
+}
+
+func TestRedisClusterStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NilError(t, err)
+	defer mr.Close()
+
+	c := testRedisConfig(RedisModeCluster, mr.Addr())
+	db, err := c.newRedisPool()
+	assert.NilError(t, err)
+
+	ctx := context.Background()
+	store := &redisStore{cfg: c, db: db, now: time.Now}
+	defer store.Close()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+		Token:  NewSecretKey(),
+	})
+	assert.NilError(t, err)
+	assert.Assert(t, mr.Exists("s:{"+key+"}"))
+	assert.Assert(t, mr.Exists("t:{"+key+"}"))
+
+	keys, err := parseFileKeys([]string{testKeyEntry("k1")})
+	assert.NilError(t, err)
+	count, err := store.rekey(ctx, keys)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, count)
+
+	sealed := &sealedStore{Store: store, keys: keys}
+	secret, err := sealed.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
+
+func TestRedisClusterMoved(t *testing.T) {
+	target, err := miniredis.Run()
+	assert.NilError(t, err)
+	defer target.Close()
+	target.Set("foo", "bar")
+
+	// a node that has handed all of its slots over to the target
+	stale, err := mrserver.NewServer("127.0.0.1:0")
+	assert.NilError(t, err)
+	defer stale.Close()
+	host, port, _ := net.SplitHostPort(stale.Addr().String())
+	portNum, err := strconv.Atoi(port)
+	assert.NilError(t, err)
+	err = stale.Register("CLUSTER", func(c *mrserver.Peer, _ string, _ []string) {
+		c.WriteLen(1)
+		c.WriteLen(3)
+		c.WriteInt(0)
+		c.WriteInt(redisClusterSlots - 1)
+		c.WriteLen(2)
+		c.WriteBulk(host)
+		c.WriteInt(portNum)
+	})
+	assert.NilError(t, err)
+	err = stale.Register("GET", func(c *mrserver.Peer, _ string, args []string) {
+		c.WriteError("MOVED " + strconv.Itoa(redisKeySlot(args[0])) + " " + target.Addr())
+	})
+	assert.NilError(t, err)
+
+	cluster := testConfig().newRedisCluster([]string{stale.Addr().String()}, func(addr string) (redis.Conn, error) {
+		return redis.Dial("tcp", addr)
+	})
+	defer cluster.Close()
+
+	conn := cluster.Get()
+	defer conn.Close()
+
+	value, err := redis.String(conn.Do("GET", "foo"))
+	assert.NilError(t, err)
+	assert.Equal(t, "bar", value)
+
+	addr, err := cluster.addrForSlot(redisKeySlot("foo"))
+	assert.NilError(t, err)
+	assert.Equal(t, target.Addr(), addr)
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	first, err := miniredis.Run()
+	assert.NilError(t, err)
+	defer first.Close()
+
+	second, err := miniredis.Run()
+	assert.NilError(t, err)
+	defer second.Close()
+
+	var failover atomic.Bool
+	roleFunc := func(master bool) mrserver.Cmd {
+		return func(c *mrserver.Peer, _ string, _ []string) {
+			c.WriteLen(1)
+			if master == !failover.Load() {
+				c.WriteBulk("master")
+			} else {
+				c.WriteBulk("slave")
+			}
+		}
+	}
+	assert.NilError(t, first.Server().Register("ROLE", roleFunc(true)))
+	assert.NilError(t, second.Server().Register("ROLE", roleFunc(false)))
+
+	sentinel, err := mrserver.NewServer("127.0.0.1:0")
+	assert.NilError(t, err)
+	defer sentinel.Close()
+	err = sentinel.Register("SENTINEL", func(c *mrserver.Peer, _ string, args []string) {
+		if len(args) != 2 || !strings.EqualFold(args[0], "get-master-addr-by-name") || args[1] != "mymaster" {
+			c.WriteNull()
+			return
+		}
+		master := first
+		if failover.Load() {
+			master = second
+		}
+		c.WriteStrings([]string{master.Host(), master.Port()})
+	})
+	assert.NilError(t, err)
+
+	// the first sentinel is down
+	c := testRedisConfig(RedisModeSentinel, "127.0.0.1:1,"+sentinel.Addr().String())
+	db, err := c.newRedisPool()
+	assert.NilError(t, err)
+	defer db.Close()
+
+	conn := db.Get()
+	_, err = conn.Do("SET", "foo", "bar")
+	assert.NilError(t, err)
+	conn.Close()
+	assert.Assert(t, first.Exists("foo"))
+
+	failover.Store(true)
+
+	conn = db.Get()
+	_, err = conn.Do("SET", "foo", "baz")
+	assert.NilError(t, err)
+	conn.Close()
+
+	value, err := second.Get("foo")
+	assert.NilError(t, err)
+	assert.Equal(t, "baz", value)
+}
+
+func TestRedisClusterLimiter(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NilError(t, err)
+	defer mr.Close()
+
+	c := testRedisConfig(RedisModeCluster, mr.Addr())
+	c.LimitCount, c.LimitPeriod = 1, time.Minute
+
+	ctx := context.Background()
+	store, err := c.newLimiterStore()
+	assert.NilError(t, err)
+	defer store.Close(ctx)
+
+	key := c.redisKey("h", hashValue("127.0.0.1"))
+	_, _, _, ok, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+
+	_, _, _, ok, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.Assert(t, mr.Exists(key))
+}
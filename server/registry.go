@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// StoreFactory opens the Store of a backend, using the options in cfg.
+type StoreFactory func(ctx context.Context, cfg Config, events *Events) (Store, error)
+
+type storeFactory func(ctx context.Context, c *config, events *Events) (Store, error)
+
+var (
+	storesMu sync.RWMutex
+	stores   = map[string]storeFactory{
+		SqliteBackend: func(ctx context.Context, c *config, events *Events) (Store, error) {
+			return c.newSqliteStore(ctx, events.audit, events.notify)
+		},
+		MemoryBackend: func(ctx context.Context, c *config, events *Events) (Store, error) {
+			return c.newMemoryStore(ctx, events.audit, events.notify)
+		},
+		RedisBackend: func(ctx context.Context, c *config, events *Events) (Store, error) {
+			return c.newRedisStore(ctx, events.audit, events.notify)
+		},
+		EtcdBackend: func(ctx context.Context, c *config, events *Events) (Store, error) {
+			return c.newEtcdStore(ctx, events.audit, events.notify)
+		},
+	}
+)
+
+// RegisterStore makes a backend available by name, as a Config.Backend
+// value and to the --backend option. Like database/sql.Register, it is
+// meant to be called from init functions, and panics on duplicate names.
+func RegisterStore(name string, factory StoreFactory) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if factory == nil {
+		panic("server: RegisterStore factory is nil")
+	}
+	if _, dup := stores[name]; dup {
+		panic("server: RegisterStore called twice for backend " + name)
+	}
+	stores[name] = func(ctx context.Context, c *config, events *Events) (Store, error) {
+		return factory(ctx, c.Config, events)
+	}
+}
+
+// StoreNames returns the sorted names of all registered backends.
+func StoreNames() []string {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+	return slices.Sorted(maps.Keys(stores))
+}
+
+func storeFactories() map[string]storeFactory {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+	return maps.Clone(stores)
+}
+
+// Events lets a store report what happens to secrets outside of
+// requests, such as their expiry. A nil Events discards all events.
+type Events struct {
+	audit  *auditLog
+	notify *notifier
+}
+
+// Retrieved sends a read receipt to the notification target of a secret.
+func (e *Events) Retrieved(target string, expireAt time.Time) {
+	if e == nil {
+		return
+	}
+	e.notify.send(target, &notifyEvent{Event: notifyRetrieved, Time: time.Now().UTC(), ExpireAt: expireAt.UTC()})
+}
+
+// Expired records a secret that expired unread, and
+// tells its notification target, if it had one.
+func (e *Events) Expired(key, target string, expireAt time.Time) {
+	if e == nil {
+		return
+	}
+	event := newAuditEvent(auditExpired, key)
+	event.ExpireAt = expireAt.UTC()
+	e.audit.record(event)
+	e.notify.send(target, &notifyEvent{Event: notifyExpired, Time: event.Time, ExpireAt: event.ExpireAt})
+}
+
+// Deleted records a secret that was deleted by its creator.
+func (e *Events) Deleted(key string, expireAt time.Time) {
+	if e == nil {
+		return
+	}
+	event := newAuditEvent(auditBurned, key)
+	event.ExpireAt = expireAt.UTC()
+	e.audit.record(event)
+}
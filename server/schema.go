@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	log "log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are named NNNN_description.sql, and are applied in
+// order of their version number, each in its own transaction.
+// Released migrations must never be changed.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const (
+	createVersionSQL = `
+create table if not exists schema_version (
+    version     integer   primary key,
+    applied_at  timestamp not null
+)`
+	hasVersionSQL = `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`
+	getVersionSQL = `SELECT coalesce(max(version), 0) FROM schema_version`
+	setVersionSQL = `INSERT INTO schema_version (version, applied_at) VALUES (?, ?)`
+)
+
+type schemaMigration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// SchemaStatus reports on the migrations of a SQLite database.
+type SchemaStatus struct {
+	Version int      `json:"version"`
+	Latest  int      `json:"latest"`
+	Pending []string `json:"pending,omitempty"`
+}
+
+func schemaMigrations() ([]schemaMigration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []schemaMigration
+	for _, entry := range entries {
+		prefix, _, found := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if !found || err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration name %q", entry.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, schemaMigration{version: version, name: entry.Name(), sql: string(data)})
+	}
+	slices.SortFunc(migrations, func(a, b schemaMigration) int { return a.version - b.version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+func schemaStatus(ctx context.Context, db *sql.DB) (*SchemaStatus, error) {
+	migrations, err := schemaMigrations()
+	if err != nil {
+		return nil, err
+	}
+	// databases from before versioned migrations have no version
+	var versioned int
+	if err = db.QueryRowContext(ctx, hasVersionSQL).Scan(&versioned); err != nil {
+		return nil, err
+	}
+	status := &SchemaStatus{}
+	if versioned > 0 {
+		if err = db.QueryRowContext(ctx, getVersionSQL).Scan(&status.Version); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range migrations {
+		status.Latest = m.version
+		if m.version > status.Version {
+			status.Pending = append(status.Pending, m.name)
+		}
+	}
+	return status, nil
+}
+
+// migrateSchema applies all pending migrations, and refuses to
+// use a database that has been migrated by a newer goldfish.
+func migrateSchema(ctx context.Context, db *sql.DB) error {
+	status, err := schemaStatus(ctx, db)
+	if err != nil {
+		return err
+	}
+	if status.Version > status.Latest {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", status.Version, status.Latest)
+	}
+	migrations, err := schemaMigrations()
+	if err != nil {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, createVersionSQL); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= status.Version {
+			continue
+		}
+		if err = applyMigration(ctx, db, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		log.Info("Applied database migration", "name", m.name)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m schemaMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, setVersionSQL, m.version, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateDatabase applies the pending migrations of the SQLite database,
+// which a server also does when it starts.
+func MigrateDatabase(ctx context.Context, cfg Config) error {
+	db, err := openSchemaDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrateSchema(ctx, db)
+}
+
+// DatabaseStatus reports on the migrations of the SQLite database, without applying them.
+// The database is opened read-only, so that it is neither created nor changed.
+func DatabaseStatus(ctx context.Context, cfg Config) (*SchemaStatus, error) {
+	if cfg.Backend != SqliteBackend {
+		return nil, fmt.Errorf("backend %q does not have a database schema", cfg.Backend)
+	}
+	db, err := newConfig(cfg).openSqliteReadOnly()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return schemaStatus(ctx, db)
+}
+
+func openSchemaDB(cfg Config) (*sql.DB, error) {
+	if cfg.Backend != SqliteBackend {
+		return nil, fmt.Errorf("backend %q does not have a database schema", cfg.Backend)
+	}
+	return newConfig(cfg).openSqliteDB()
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSchemaMigrations(t *testing.T) {
+	migrations, err := schemaMigrations()
+	assert.NilError(t, err)
+	assert.Assert(t, len(migrations) > 0)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, m.name)
+	}
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+
+	// checking a missing database does not create it
+	_, err := DatabaseStatus(ctx, cfg)
+	assert.ErrorContains(t, err, "does not exist")
+	_, err = os.Stat(cfg.SqliteFile)
+	assert.Assert(t, errors.Is(err, fs.ErrNotExist), err)
+
+	// nor does checking change an empty database
+	assert.NilError(t, os.WriteFile(cfg.SqliteFile, nil, 0o600))
+	status, err := DatabaseStatus(ctx, cfg)
+	assert.NilError(t, err)
+	info, err := os.Stat(cfg.SqliteFile)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	assert.Equal(t, 0, status.Version)
+	assert.Equal(t, status.Latest, len(status.Pending))
+	assert.Equal(t, "0001_initial.sql", status.Pending[0])
+
+	assert.NilError(t, MigrateDatabase(ctx, cfg))
+
+	status, err = DatabaseStatus(ctx, cfg)
+	assert.NilError(t, err)
+	assert.Equal(t, status.Latest, status.Version)
+	assert.Equal(t, 0, len(status.Pending))
+
+	// and again, with nothing to do
+	assert.NilError(t, MigrateDatabase(ctx, cfg))
+}
+
+func TestMigrateDatabase_Unversioned(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+
+	db, err := newConfig(cfg).openSqliteDB()
+	assert.NilError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`create table secrets (secret_key text primary key, secret_value text not null, expire_at timestamp not null)`)
+	assert.NilError(t, err)
+	_, err = db.Exec(`INSERT INTO secrets VALUES ('abc', 'wibble', ?)`, time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+
+	assert.NilError(t, migrateSchema(ctx, db))
+
+	var secret string
+	assert.NilError(t, db.QueryRow(`SELECT secret_value FROM secrets WHERE secret_key = 'abc'`).Scan(&secret))
+	assert.Equal(t, "wibble", secret)
+}
+
+func TestMigrateDatabase_Newer(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+	assert.NilError(t, MigrateDatabase(ctx, cfg))
+
+	db, err := newConfig(cfg).openSqliteDB()
+	assert.NilError(t, err)
+	defer db.Close()
+	_, err = db.Exec(setVersionSQL, 9999, time.Now())
+	assert.NilError(t, err)
+
+	_, err = NewServer(cfg)
+	assert.ErrorContains(t, err, "database schema version 9999 is newer")
+}
+
+func TestMigrateDatabase_NotSqlite(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backend = RedisBackend
+	assert.ErrorContains(t, MigrateDatabase(context.Background(), cfg), "does not have a database schema")
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tomcz/gotools/quiet"
+)
+
+// States of a secret, as reported by SecretStatus.
+const (
+	StatusPending   = "pending"
+	StatusRetrieved = "retrieved"
+	StatusExpired   = "expired"
+	StatusRevoked   = "revoked"
+)
+
+// Secret status is kept beyond the expiry of a secret so
+// that its creator can still find out what happened to it.
+const statusRetention = 24 * time.Hour
+
+var (
+	// ErrNotFound is returned for unknown secret keys and management tokens.
+	ErrNotFound = errors.New("secret not found")
+	// ErrExpired is returned for secrets that a store knows to have expired.
+	ErrExpired = errors.New("secret expired")
+	// ErrFull is returned when a store has no room for another secret.
+	ErrFull = errors.New("secret storage is full")
+	// ErrLocked matches a LockedError.
+	ErrLocked = errors.New("secret is locked")
+)
+
+// LockedError is returned for secrets that cannot be taken before
+// their NotBefore time, which are left in the store until then.
+type LockedError struct {
+	NotBefore time.Time
+}
+
+func (e *LockedError) Error() string {
+	return "secret is locked until " + e.NotBefore.UTC().Format(time.RFC3339)
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+type SecretWithTTL struct {
+	// Key, when set, is the key that Put stores the secret under,
+	// rather than a new one, so that encrypted values can be bound
+	// to their keys; it comes from NewSecretKey.
+	Key    string
+	Secret string
+	TTL    time.Duration
+	Notify string
+	Token  string // management token; stores only keep its hash
+	// NotBefore, when set, is the time from which the secret can be taken.
+	NotBefore time.Time
+	// AllowedCIDRs, when set, are the networks that the secret can be taken from.
+	AllowedCIDRs []netip.Prefix
+}
+
+type SecretStatus struct {
+	State    string    `json:"state"`
+	ExpireAt time.Time `json:"expire_at"`
+	// payload is the payload reference of a secret that
+	// Delete revoked, so that its object can be removed.
+	payload string
+}
+
+// SecretPeek tells a recipient whether a secret can still be taken.
+type SecretPeek struct {
+	Exists    bool      `json:"exists"`
+	ExpireAt  time.Time `json:"expire_at,omitzero"`
+	NotBefore time.Time `json:"not_before,omitzero"`
+	// AllowedCIDRs are not shown to recipients.
+	AllowedCIDRs []netip.Prefix `json:"-"`
+	// payload is the payload reference of a secret, so
+	// that its object can be read before it is taken.
+	payload string
+}
+
+// Stats never include secret keys or values.
+type Stats struct {
+	Secrets int `json:"secrets"`
+	// The earliest and latest expiry of the counted secrets,
+	// which are zero when there are none.
+	OldestExpireAt time.Time `json:"oldest_expire_at,omitzero"`
+	NewestExpireAt time.Time `json:"newest_expire_at,omitzero"`
+}
+
+// Store keeps secret values, which have already been encrypted by the
+// browser, until they are taken, deleted, or expire. Stores return
+// ErrNotFound, or ErrExpired, for secrets that cannot be taken.
+type Store interface {
+	// Put stores a secret under a new key from NewSecretKey.
+	Put(ctx context.Context, secret *SecretWithTTL) (key string, err error)
+	// Take removes and returns a secret, so that it can only be taken once.
+	Take(ctx context.Context, key string) (secret string, err error)
+	// Peek reports on a secret that can still be taken, without taking it.
+	Peek(ctx context.Context, key string) (*SecretPeek, error)
+	// Status reports on the secret stored with a management token.
+	Status(ctx context.Context, token string) (*SecretStatus, error)
+	// Delete removes a pending secret by its management token.
+	Delete(ctx context.Context, token string) (*SecretStatus, error)
+	// Stats counts the secrets that have not been taken or deleted.
+	Stats(ctx context.Context) (*Stats, error)
+	io.Closer
+}
+
+// newKey is the key that Put stores a secret under.
+func (s *SecretWithTTL) newKey() string {
+	if s.Key != "" {
+		return s.Key
+	}
+	return NewSecretKey()
+}
+
+var validSecretKey = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// NewSecretKey returns a random key, in the form that the webapp expects.
+func NewSecretKey() string {
+	return strings.ToLower(strings.ReplaceAll(uuid.NewString(), "-", ""))
+}
+
+func (c *config) newSecretStore(ctx context.Context, audit *auditLog, notify *notifier) (Store, error) {
+	keys, err := c.newKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		if err = checkKeyProvider(ctx, keys); err != nil {
+			return nil, err
+		}
+	}
+	store, err := c.newBackendStore(ctx, audit, notify)
+	if err != nil {
+		return nil, err
+	}
+	if c.S3Bucket != "" {
+		payloads, err := c.newPayloadStore(ctx, store)
+		if err != nil {
+			quiet.Close(store)
+			return nil, err
+		}
+		store = payloads
+	}
+	if keys == nil {
+		return store, nil
+	}
+	return &sealedStore{Store: store, keys: keys}, nil
+}
+
+func (c *config) newBackendStore(ctx context.Context, audit *auditLog, notify *notifier) (Store, error) {
+	open, found := storeFactories()[c.Backend]
+	if !found {
+		return nil, fmt.Errorf("unknown backend storage %q", c.Backend)
+	}
+	return open(ctx, c, &Events{audit: audit, notify: notify})
+}
+
+// formatCIDRs is the stored form of allowed CIDRs,
+// which is empty for secrets without any.
+func formatCIDRs(prefixes []netip.Prefix) string {
+	cidrs := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		cidrs[i] = prefix.String()
+	}
+	return strings.Join(cidrs, ",")
+}
+
+func parseCIDRs(cidrs string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for cidr := range strings.SplitSeq(cidrs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"testing"
@@ -8,7 +8,7 @@ import (
 
 func TestNewSecretsKey(t *testing.T) {
 	for i := 0; i < 100; i++ {
-		key := newSecretKey()
+		key := NewSecretKey()
 		assert.Assert(t, validSecretKey.MatchString(key), key)
 	}
 }
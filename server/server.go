@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/tomcz/gotools/quiet"
+)
+
+const gracefulTimeout = 100 * time.Millisecond
+
+// Server is the goldfish webapp and its secret storage. It can be
+// used as the handler of an http.Server, or mounted in another mux
+// behind authentication, as long as it is mounted at the root path.
+type Server struct {
+	cfg     *config
+	handler http.Handler
+	audit   *auditLog
+	notify  *notifier
+	secrets Store
+	limits  limiter.Store
+	cancel  context.CancelFunc
+}
+
+// NewServer connects to the configured backend and starts the background
+// work of the backend, which runs until the server is closed.
+func NewServer(cfg Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := loadConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{cfg: c, cancel: cancel}
+	if err = s.open(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.handler = c.newHandler(s.secrets, s.limits, s.audit)
+	return s, nil
+}
+
+func (s *Server) open(ctx context.Context) error {
+	var err error
+	if s.audit, err = s.cfg.newAuditLog(); err != nil {
+		return err
+	}
+	s.notify = s.cfg.newNotifier()
+	if s.secrets, err = s.cfg.newSecretStore(ctx, s.audit, s.notify); err != nil {
+		return err
+	}
+	s.limits, err = s.cfg.newLimiterStore()
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// ReloadCredentials re-reads the credential file options, and keeps
+// the current value of any credential whose file cannot be read.
+func (s *Server) ReloadCredentials() {
+	s.cfg.reloadCredentialFiles()
+}
+
+// Close stops background work and closes the backend.
+func (s *Server) Close() error {
+	s.cancel()
+	if s.limits != nil {
+		quiet.CloseWithTimeout(s.limits.Close, gracefulTimeout)
+	}
+	var err error
+	if s.secrets != nil {
+		err = s.secrets.Close()
+	}
+	return errors.Join(err, s.notify.Close(), s.audit.Close())
+}
+
+// ReadStats opens the configured backend to count its secrets. Secrets
+// of the memory backend can only be counted by the admin endpoint.
+func ReadStats(ctx context.Context, cfg Config) (*Stats, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Backend == MemoryBackend {
+		return nil, errors.New("the memory backend can only be read by its server")
+	}
+	c, err := loadConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	store, err := c.newBackendStore(ctx, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer quiet.Close(store)
+	return store.Stats(ctx)
+}
+
+// Rekey re-encrypts the stored secrets of the configured
+// backend with the primary encryption key.
+func Rekey(ctx context.Context, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	c, err := loadConfig(cfg)
+	if err != nil {
+		return err
+	}
+	keys, err := c.newKeyProvider()
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return errors.New("no encryption keys have been configured")
+	}
+	if err = checkKeyProvider(ctx, keys); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	store, err := c.newBackendStore(ctx, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer quiet.Close(store)
+
+	rekey, ok := store.(rekeyStore)
+	if !ok {
+		return fmt.Errorf("backend %q does not support rekeying", c.Backend)
+	}
+	count, err := rekey.rekey(ctx, keys)
+	if err == nil && c.S3Bucket != "" {
+		var objects int
+		objects, err = c.rekeyPayloads(ctx, keys)
+		count += objects
+	}
+	log.Info("Re-encrypted secrets", "count", count, "key_id", keys.KeyID())
+	return err
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/assert/cmp"
+)
+
+func testConfig() *config {
+	return newConfig(DefaultConfig())
+}
+
+func testPost(t *testing.T, handler http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+func TestNewServer(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NilError(t, err)
+	t.Cleanup(mr.Close)
+
+	sqlite := DefaultConfig()
+	sqlite.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+
+	blue := DefaultConfig()
+	blue.Backend = RedisBackend
+	blue.RedisAddr = mr.Addr()
+	blue.RedisNS = "blue"
+
+	green := blue
+	green.RedisNS = "green"
+	green.LimitCount = 2
+
+	for name, cfg := range map[string]Config{"sqlite": sqlite, "blue": blue, "green": green} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			srv, err := NewServer(cfg)
+			assert.NilError(t, err)
+			t.Cleanup(func() { srv.Close() })
+
+			// embedded behind the authentication of another mux
+			mux := http.NewServeMux()
+			mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Sec-Fetch-Site") == "" {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				srv.ServeHTTP(w, r)
+			}))
+
+			res := testPost(t, mux, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}})
+			assert.Equal(t, http.StatusOK, res.Code)
+			key := res.Body.String()
+			if cfg.Backend == RedisBackend {
+				assert.Assert(t, mr.Exists(cfg.RedisNS+":s:"+key))
+			}
+
+			res = testPost(t, mux, "/pull", url.Values{"key": {key}})
+			assert.Equal(t, http.StatusOK, res.Code)
+			body, _ := io.ReadAll(res.Body)
+			assert.Equal(t, "wibble", string(body))
+
+			res = testPost(t, mux, "/pull", url.Values{"key": {key}})
+			if cfg.LimitCount == 2 {
+				assert.Equal(t, http.StatusTooManyRequests, res.Code)
+			} else {
+				assert.Equal(t, http.StatusNotFound, res.Code)
+			}
+		})
+	}
+}
+
+func TestPeek(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backend = MemoryBackend
+	cfg.LimitCount = 0
+	srv, err := NewServer(cfg)
+	assert.NilError(t, err)
+	defer srv.Close()
+
+	res := testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"2"}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	key := res.Body.String()
+
+	for range 2 {
+		res = testPost(t, srv, "/peek", url.Values{"key": {key}})
+		assert.Equal(t, http.StatusOK, res.Code)
+		var peek SecretPeek
+		assert.NilError(t, json.NewDecoder(res.Body).Decode(&peek))
+		assert.Assert(t, peek.Exists)
+		assert.Assert(t, peek.ExpireAt.After(time.Now().Add(time.Hour)), peek.ExpireAt)
+	}
+
+	res = testPost(t, srv, "/pull", url.Values{"key": {key}})
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = testPost(t, srv, "/peek", url.Values{"key": {key}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"exists":false}`+"\n", res.Body.String())
+
+	res = testPost(t, srv, "/peek", url.Values{"key": {"wibble"}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestNotBefore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backend = MemoryBackend
+	cfg.LimitCount = 0
+	srv, err := NewServer(cfg)
+	assert.NilError(t, err)
+	defer srv.Close()
+
+	notBefore := time.Now().Add(30 * time.Minute).UTC().Truncate(time.Second)
+	res := testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}, "not_before": {notBefore.Format(time.RFC3339)}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	key := res.Body.String()
+
+	res = testPost(t, srv, "/pull", url.Values{"key": {key}})
+	assert.Equal(t, http.StatusLocked, res.Code)
+	wait, err := strconv.Atoi(res.Header().Get("Retry-After"))
+	assert.NilError(t, err)
+	assert.Assert(t, wait > 1790 && wait <= 1800, wait)
+	assert.Assert(t, strings.Contains(res.Body.String(), notBefore.Format(time.RFC3339)), res.Body.String())
+
+	res = testPost(t, srv, "/peek", url.Values{"key": {key}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	var peek SecretPeek
+	assert.NilError(t, json.NewDecoder(res.Body).Decode(&peek))
+	assert.Assert(t, peek.Exists)
+	assert.Assert(t, peek.NotBefore.Equal(notBefore), peek.NotBefore)
+
+	res = testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}, "not_before": {"tomorrow"}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	tooLate := time.Now().Add(2 * time.Hour).Format(time.RFC3339)
+	res = testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}, "not_before": {tooLate}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestAllowedCIDRs(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backend = MemoryBackend
+	cfg.LimitCount = 0
+	cfg.AllowedCIDRs = "10.8.0.0/16"
+	srv, err := NewServer(cfg)
+	assert.NilError(t, err)
+	defer srv.Close()
+
+	pull := func(key, remoteAddr string) *httptest.ResponseRecorder {
+		form := url.Values{"key": {key}}
+		req := httptest.NewRequest(http.MethodPost, "/pull", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		req.RemoteAddr = remoteAddr
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, req)
+		return res
+	}
+
+	res := testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}, "cidrs": {"10.8.4.0/24"}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	key := res.Body.String()
+
+	// refused attempts do not consume the secret
+	for _, addr := range []string{"192.0.2.1:1234", "10.8.5.1:1234"} {
+		res = pull(key, addr)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	}
+
+	res = pull(key, "10.8.4.1:1234")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "wibble", res.Body.String())
+
+	res = pull(key, "10.8.4.1:1234")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}, "cidrs": {"10.0.0.0/8"}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}, "cidrs": {"wobble"}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestNewServer_Invalid(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backend = "mongo"
+	_, err := NewServer(cfg)
+	assert.ErrorContains(t, err, `invalid backend "mongo"`)
+
+	cfg = DefaultConfig()
+	cfg.SqliteJournalMode = "wobble"
+	_, err = NewServer(cfg)
+	assert.ErrorContains(t, err, `invalid sqlite-journal-mode "wobble"`)
+
+	cfg = DefaultConfig()
+	cfg.AllowedCIDRs = "10.8.0.0/33"
+	_, err = NewServer(cfg)
+	assert.ErrorContains(t, err, "invalid allowed-cidrs")
+}
+
+func TestRedisKey(t *testing.T) {
+	tests := []struct {
+		mode, ns, want string
+	}{
+		{RedisModeStandalone, "", "s:abc"},
+		{RedisModeStandalone, "goldfish", "goldfish:s:abc"},
+		{RedisModeCluster, "", "s:{abc}"},
+		{RedisModeCluster, "goldfish", "goldfish:s:{abc}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			t.Parallel()
+			c := testConfig()
+			c.RedisMode, c.RedisNS = tt.mode, tt.ns
+			assert.Equal(t, tt.want, c.redisKey("s", "abc"))
+		})
+	}
+}
+
+func TestLimiterKeyFunc(t *testing.T) {
+	tests := []struct {
+		backend, headers, want string
+	}{
+		{MemoryBackend, "", "192.0.2.1"},
+		{MemoryBackend, "X-Real-IP", "198.51.100.7"},
+		{SqliteBackend, "", hashValue("192.0.2.1")},
+		{RedisBackend, "", "h:" + hashValue("192.0.2.1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			t.Parallel()
+			c := testConfig()
+			c.Backend, c.LimitHeaders = tt.backend, tt.headers
+			req := httptest.NewRequest(http.MethodPost, "/pull", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Real-IP", "198.51.100.7")
+			key, err := c.newLimiterKeyFunc()(req)
+			assert.NilError(t, err)
+			assert.Equal(t, tt.want, key)
+		})
+	}
+}
+
+func TestRegisterStore(t *testing.T) {
+	var opened Config
+	RegisterStore("wibble", func(ctx context.Context, cfg Config, events *Events) (Store, error) {
+		opened = cfg
+		c := newConfig(cfg)
+		c.SqliteFile = filepath.Join(t.TempDir(), "wibble.db")
+		return c.newSqliteStore(ctx, events.audit, events.notify)
+	})
+	assert.Assert(t, slices.Contains(StoreNames(), "wibble"))
+	assert.Assert(t, cmp.Panics(func() { RegisterStore("wibble", nil) }))
+	assert.Assert(t, cmp.Panics(func() {
+		RegisterStore(SqliteBackend, func(context.Context, Config, *Events) (Store, error) { return nil, nil })
+	}))
+
+	cfg := DefaultConfig()
+	cfg.Backend = "wibble"
+	srv, err := NewServer(cfg)
+	assert.NilError(t, err)
+	defer srv.Close()
+	assert.Equal(t, "wibble", opened.Backend)
+
+	res := testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}})
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestAdminStats(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+	cfg.AdminToken = "wibble"
+	srv, err := NewServer(cfg)
+	assert.NilError(t, err)
+	defer srv.Close()
+
+	res := testPost(t, srv, "/push", url.Values{"secret": {"wobble"}, "ttl": {"1"}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	key := res.Body.String()
+
+	for _, auth := range []string{"", "Bearer wobble", "wibble"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+		req.Header.Set("Authorization", auth)
+		res = httptest.NewRecorder()
+		srv.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusUnauthorized, res.Code, auth)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer wibble")
+	res = httptest.NewRecorder()
+	srv.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	body := res.Body.String()
+	assert.Assert(t, cmp.Contains(body, `"secrets":1`))
+	assert.Assert(t, cmp.Contains(body, `"oldest_expire_at"`))
+	assert.Assert(t, !strings.Contains(body, key))
+	assert.Assert(t, !strings.Contains(body, "wobble"))
+
+	stats, err := ReadStats(context.Background(), cfg)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, stats.Secrets)
+}
+
+func TestAdminStats_Disabled(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+	srv, err := NewServer(cfg)
+	assert.NilError(t, err)
+	defer srv.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestNewServer_SqliteLimitsRestart(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+	cfg.LimitCount = 1
+
+	srv, err := NewServer(cfg)
+	assert.NilError(t, err)
+	res := testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.NilError(t, srv.Close())
+
+	srv, err = NewServer(cfg)
+	assert.NilError(t, err)
+	defer srv.Close()
+	res = testPost(t, srv, "/push", url.Values{"secret": {"wibble"}, "ttl": {"1"}})
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+}
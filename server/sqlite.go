@@ -0,0 +1,554 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	log "log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	setSecretSQL  = `INSERT INTO secrets (secret_key, secret_value, expire_at, not_before, allowed_cidrs) VALUES (?, ?, ?, ?, ?)`
+	getSecretSQL  = `SELECT secret_value, expire_at, not_before FROM secrets WHERE secret_key = ?`
+	peekSecretSQL = `SELECT secret_value, expire_at, not_before, coalesce(allowed_cidrs, '') FROM secrets WHERE secret_key = ?`
+	deleteKeySQL  = `DELETE FROM secrets WHERE secret_key = ?`
+	revokeKeySQL  = `DELETE FROM secrets WHERE secret_key = ? RETURNING secret_value`
+	expireSQL     = `DELETE FROM secrets WHERE expire_at < ? RETURNING secret_key, expire_at`
+
+	setNotifySQL    = `INSERT INTO notifications (secret_key, target, expire_at) VALUES (?, ?, ?)`
+	deleteNotifySQL = `DELETE FROM notifications WHERE secret_key = ? RETURNING target, expire_at`
+	expireNotifySQL = `DELETE FROM notifications WHERE expire_at < ? RETURNING target, expire_at`
+	clearNotifySQL  = `DELETE FROM notifications WHERE secret_key = ?`
+
+	setReceiptSQL    = `INSERT INTO receipts (manage_hash, secret_key, state, expire_at) VALUES (?, ?, ?, ?)`
+	getReceiptSQL    = `SELECT secret_key, state, expire_at FROM receipts WHERE manage_hash = ?`
+	updateReceiptSQL = `UPDATE receipts SET state = ? WHERE secret_key = ?`
+	expireReceiptSQL = `DELETE FROM receipts WHERE expire_at < ?`
+
+	listSecretsSQL  = `SELECT secret_key, secret_value FROM secrets WHERE expire_at > ?`
+	rekeySecretSQL  = `UPDATE secrets SET secret_value = ? WHERE secret_key = ? AND secret_value = ?`
+	countSecretsSQL = `SELECT count(*) FROM secrets WHERE expire_at > ?`
+	oldestSecretSQL = `SELECT expire_at FROM secrets WHERE expire_at > ? ORDER BY expire_at LIMIT 1`
+	newestSecretSQL = `SELECT expire_at FROM secrets WHERE expire_at > ? ORDER BY expire_at DESC LIMIT 1`
+
+	deleteReceiptSQL = `DELETE FROM receipts WHERE secret_key = ?`
+	exportSecretsSQL = `
+SELECT s.secret_key, s.secret_value, s.expire_at, s.not_before, coalesce(s.allowed_cidrs, ''),
+       coalesce(n.target, ''), coalesce(r.manage_hash, '')
+FROM secrets s
+LEFT JOIN notifications n ON n.secret_key = s.secret_key
+LEFT JOIN receipts r ON r.secret_key = s.secret_key
+WHERE s.expire_at > ? AND s.secret_key > ?
+ORDER BY s.secret_key
+LIMIT ?`
+)
+
+const exportPageSize = 100
+
+const (
+	autoVacuumSQL = `PRAGMA auto_vacuum`
+	vacuumSQL     = `VACUUM`
+	// deleted secrets are overwritten by secure_delete, but their pages
+	// stay in the database file, and older copies in the write-ahead log
+	incrementalVacuumSQL = `PRAGMA incremental_vacuum`
+	checkpointSQL        = `PRAGMA wal_checkpoint(TRUNCATE)`
+)
+
+type sqliteStore struct {
+	db     *sql.DB
+	now    func() time.Time
+	audit  *auditLog
+	notify *notifier
+
+	// statements of the most frequent queries, prepared on first use
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
+}
+
+func (c *config) newSqliteStore(ctx context.Context, audit *auditLog, notify *notifier) (Store, error) {
+	log.Info("Using SQLite secret store", "path", c.SqliteFile)
+	db, err := c.openSqliteDB()
+	if err != nil {
+		return nil, err
+	}
+	if err = migrateSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = enableIncrementalVacuum(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	store := &sqliteStore{
+		db:     db,
+		now:    time.Now,
+		audit:  audit,
+		notify: notify,
+	}
+	go store.regularDatabaseCleanup(ctx, c.SqliteClean)
+	return store, nil
+}
+
+func (c *config) openSqliteDB() (*sql.DB, error) {
+	params := url.Values{}
+	params.Set("_secure_delete", "on")
+	params.Set("_auto_vacuum", "incremental")
+	params.Set("_journal_mode", c.SqliteJournalMode)
+	params.Set("_synchronous", c.SqliteSynchronous)
+	params.Set("_busy_timeout", strconv.FormatInt(c.SqliteBusyTimeout.Milliseconds(), 10))
+	dsn := fmt.Sprintf("file:%s?%s", c.SqliteFile, params.Encode())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(c.SqliteMaxOpenConns)
+	db.SetMaxIdleConns(c.SqliteMaxIdleConns)
+	return db, nil
+}
+
+// openSqliteReadOnly does not create a missing database, and
+// leaves the pragmas that openSqliteDB sets as they are.
+func (c *config) openSqliteReadOnly() (*sql.DB, error) {
+	if _, err := os.Stat(c.SqliteFile); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("sqlite database %s does not exist", c.SqliteFile)
+		}
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("mode", "ro")
+	params.Set("_busy_timeout", strconv.FormatInt(c.SqliteBusyTimeout.Milliseconds(), 10))
+	dsn := fmt.Sprintf("file:%s?%s", c.SqliteFile, params.Encode())
+	return sql.Open("sqlite3", dsn)
+}
+
+// enableIncrementalVacuum converts databases that were created before
+// auto_vacuum was set, which can only be done by rebuilding them.
+func enableIncrementalVacuum(ctx context.Context, db *sql.DB) error {
+	var mode int
+	if err := db.QueryRowContext(ctx, autoVacuumSQL).Scan(&mode); err != nil {
+		return err
+	}
+	if mode == 2 {
+		return nil
+	}
+	log.Info("Rebuilding SQLite database for incremental vacuum")
+	_, err := db.ExecContext(ctx, vacuumSQL)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	s.stmtsMu.Lock()
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	s.stmts = nil
+	s.stmtsMu.Unlock()
+	return s.db.Close()
+}
+
+func (s *sqliteStore) prepared(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.stmtsMu.Lock()
+	defer s.stmtsMu.Unlock()
+	if stmt, found := s.stmts[query]; found {
+		return stmt, nil
+	}
+	stmt, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if s.stmts == nil {
+		s.stmts = make(map[string]*sql.Stmt)
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (s *sqliteStore) Put(ctx context.Context, req *SecretWithTTL) (string, error) {
+	secret := &storedSecret{
+		key:       req.newKey(),
+		value:     req.Secret,
+		expireAt:  s.now().Add(req.TTL),
+		notify:    req.Notify,
+		notBefore: req.NotBefore,
+		cidrs:     formatCIDRs(req.AllowedCIDRs),
+	}
+	if req.Token != "" {
+		secret.manageHash = hashValue(req.Token)
+	}
+	return secret.key, s.put(ctx, secret)
+}
+
+func (s *sqliteStore) put(ctx context.Context, secret *storedSecret) error {
+	setSecret, err := s.prepared(ctx, setSecretSQL)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.StmtContext(ctx, setSecret).ExecContext(ctx, secret.key, secret.value, secret.expireAt, nullTime(secret.notBefore), nullString(secret.cidrs)); err != nil {
+		return err
+	}
+	if secret.notify != "" {
+		if _, err = tx.ExecContext(ctx, setNotifySQL, secret.key, secret.notify, secret.expireAt); err != nil {
+			return err
+		}
+	}
+	if secret.manageHash != "" {
+		if _, err = tx.ExecContext(ctx, setReceiptSQL, secret.manageHash, secret.key, StatusPending, secret.expireAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Take(ctx context.Context, key string) (string, error) {
+	getSecret, err := s.prepared(ctx, getSecretSQL)
+	if err != nil {
+		return "", err
+	}
+	var secret string
+	var expireAt time.Time
+	var notBefore sql.NullTime
+	err = getSecret.QueryRowContext(ctx, key).Scan(&secret, &expireAt, &notBefore)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	// expired secrets are left for regularDatabaseCleanup to report
+	if !expireAt.After(s.now()) {
+		return "", ErrExpired
+	}
+	if notBefore.Valid && notBefore.Time.After(s.now()) {
+		return "", &LockedError{NotBefore: notBefore.Time.UTC()}
+	}
+	// only one of the requests that read the secret can delete it
+	res, err := s.db.ExecContext(ctx, deleteKeySQL, key)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n != 1 {
+		return "", ErrNotFound
+	}
+	_, err = s.db.ExecContext(ctx, updateReceiptSQL, StatusRetrieved, key)
+	if err != nil {
+		log.Warn("failed to update receipt", "err", err)
+	}
+	var target string
+	err = s.db.QueryRowContext(ctx, deleteNotifySQL, key).Scan(&target, &expireAt)
+	if err == nil {
+		s.notify.send(target, &notifyEvent{Event: notifyRetrieved, Time: s.now().UTC(), ExpireAt: expireAt.UTC()})
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		log.Warn("failed to delete notification", "err", err)
+	}
+	return secret, nil
+}
+
+func (s *sqliteStore) Peek(ctx context.Context, key string) (*SecretPeek, error) {
+	var value string
+	var expireAt time.Time
+	var notBefore sql.NullTime
+	var cidrs string
+	err := s.db.QueryRowContext(ctx, peekSecretSQL, key).Scan(&value, &expireAt, &notBefore, &cidrs)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if !expireAt.After(s.now()) {
+		return nil, ErrExpired
+	}
+	allowed, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretPeek{Exists: true, ExpireAt: expireAt.UTC(), NotBefore: notBefore.Time.UTC(), AllowedCIDRs: allowed, payload: payloadRef(value)}, nil
+}
+
+func (s *sqliteStore) Status(ctx context.Context, token string) (*SecretStatus, error) {
+	var key string
+	status := &SecretStatus{}
+	err := s.db.QueryRowContext(ctx, getReceiptSQL, hashValue(token)).Scan(&key, &status.State, &status.ExpireAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if status.State == StatusPending && !status.ExpireAt.After(s.now()) {
+		status.State = StatusExpired
+	}
+	status.ExpireAt = status.ExpireAt.UTC()
+	return status, nil
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, token string) (*SecretStatus, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var key string
+	status := &SecretStatus{}
+	err = tx.QueryRowContext(ctx, getReceiptSQL, hashValue(token)).Scan(&key, &status.State, &status.ExpireAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	status.ExpireAt = status.ExpireAt.UTC()
+	if status.State != StatusPending {
+		return status, nil
+	}
+	if !status.ExpireAt.After(s.now()) {
+		status.State = StatusExpired
+		return status, nil
+	}
+	var value string
+	err = tx.QueryRowContext(ctx, revokeKeySQL, key).Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, clearNotifySQL, key); err != nil {
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, updateReceiptSQL, StatusRevoked, key); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	event := newAuditEvent(auditBurned, key)
+	event.ExpireAt = status.ExpireAt
+	s.audit.record(event)
+	status.State = StatusRevoked
+	status.payload = payloadRef(value)
+	return status, nil
+}
+
+func (s *sqliteStore) Stats(ctx context.Context) (*Stats, error) {
+	now := s.now()
+	stats := &Stats{}
+	err := s.db.QueryRowContext(ctx, countSecretsSQL, now).Scan(&stats.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	// min and max would lose the timestamp type of expire_at
+	for query, expireAt := range map[string]*time.Time{oldestSecretSQL: &stats.OldestExpireAt, newestSecretSQL: &stats.NewestExpireAt} {
+		err = s.db.QueryRowContext(ctx, query, now).Scan(expireAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		*expireAt = expireAt.UTC()
+	}
+	return stats, nil
+}
+
+func (s *sqliteStore) rekey(ctx context.Context, keys KeyProvider) (int, error) {
+	rows, err := s.db.QueryContext(ctx, listSecretsSQL, s.now())
+	if err != nil {
+		return 0, err
+	}
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if needsRekey(keys, value, hashValue(key)) {
+			values[key] = value
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	var count int
+	for key, value := range values {
+		sealed, err := resealValue(ctx, keys, value, hashValue(key))
+		if err != nil {
+			return count, err
+		}
+		// retrieved secrets are not updated
+		res, err := s.db.ExecContext(ctx, rekeySecretSQL, sealed, key, value)
+		if err != nil {
+			return count, err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			count += int(n)
+		}
+	}
+	return count, nil
+}
+
+func (s *sqliteStore) regularDatabaseCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.expireSecrets(ctx, now)
+			s.compact(ctx)
+		}
+	}
+}
+
+// compact removes deleted secrets from the free pages of the
+// database file, and from the write-ahead log in WAL mode.
+func (s *sqliteStore) compact(ctx context.Context) {
+	if _, err := s.db.ExecContext(ctx, incrementalVacuumSQL); err != nil {
+		log.Warn("incremental vacuum failed", "err", err)
+	}
+	var busy, frames, checkpointed int
+	err := s.db.QueryRowContext(ctx, checkpointSQL).Scan(&busy, &frames, &checkpointed)
+	if err != nil {
+		log.Warn("wal checkpoint failed", "err", err)
+	} else if busy != 0 {
+		log.Warn("wal checkpoint was blocked by readers")
+	}
+}
+
+func (s *sqliteStore) expireSecrets(ctx context.Context, now time.Time) {
+	s.expireRows(ctx, expireSQL, now, func(key string, expireAt time.Time) {
+		event := newAuditEvent(auditExpired, key)
+		event.ExpireAt = expireAt.UTC()
+		s.audit.record(event)
+	})
+	// retrieved secrets have already removed their notifications
+	s.expireRows(ctx, expireNotifySQL, now, func(target string, expireAt time.Time) {
+		s.notify.send(target, &notifyEvent{Event: notifyExpired, Time: now.UTC(), ExpireAt: expireAt.UTC()})
+	})
+	_, err := s.db.ExecContext(ctx, expireReceiptSQL, now.Add(-statusRetention))
+	if err != nil {
+		log.Warn("expire receipts failed", "err", err)
+	}
+	_, err = s.db.ExecContext(ctx, expireLimitsSQL, now.UnixNano())
+	if err != nil {
+		log.Warn("expire rate limits failed", "err", err)
+	}
+}
+
+func (s *sqliteStore) expireRows(ctx context.Context, query string, now time.Time, expired func(string, time.Time)) {
+	rows, err := s.db.QueryContext(ctx, query, now)
+	if err != nil {
+		log.Warn("expire secrets failed", "err", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		var expireAt time.Time
+		if err = rows.Scan(&value, &expireAt); err != nil {
+			log.Warn("expire secrets failed", "err", err)
+			return
+		}
+		expired(value, expireAt)
+	}
+	if err = rows.Err(); err != nil {
+		log.Warn("expire secrets failed", "err", err)
+	}
+}
+
+func (s *sqliteStore) exportSecrets(ctx context.Context, fn func(secret *storedSecret) error) error {
+	// pages of secrets are read before they are visited,
+	// so that they can be removed without a busy database
+	var after string
+	for {
+		page, err := s.exportPage(ctx, after)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		for _, secret := range page {
+			if err = fn(secret); err != nil {
+				return err
+			}
+		}
+		after = page[len(page)-1].key
+	}
+}
+
+func (s *sqliteStore) exportPage(ctx context.Context, after string) ([]*storedSecret, error) {
+	rows, err := s.db.QueryContext(ctx, exportSecretsSQL, s.now(), after, exportPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var page []*storedSecret
+	for rows.Next() {
+		secret := &storedSecret{}
+		var notBefore sql.NullTime
+		if err = rows.Scan(&secret.key, &secret.value, &secret.expireAt, &notBefore, &secret.cidrs, &secret.notify, &secret.manageHash); err != nil {
+			return nil, err
+		}
+		secret.notBefore = notBefore.Time
+		page = append(page, secret)
+	}
+	return page, rows.Err()
+}
+
+func (s *sqliteStore) importSecret(ctx context.Context, secret *storedSecret) error {
+	return s.put(ctx, secret)
+}
+
+func (s *sqliteStore) lookupSecret(ctx context.Context, key string) (string, error) {
+	getSecret, err := s.prepared(ctx, getSecretSQL)
+	if err != nil {
+		return "", err
+	}
+	var secret string
+	var expireAt time.Time
+	var notBefore sql.NullTime
+	err = getSecret.QueryRowContext(ctx, key).Scan(&secret, &expireAt, &notBefore)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return secret, err
+}
+
+func (s *sqliteStore) removeSecret(ctx context.Context, secret *storedSecret) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{deleteKeySQL, clearNotifySQL, deleteReceiptSQL} {
+		if _, err = tx.ExecContext(ctx, query, secret.key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nullTime and nullString keep unset values as null.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
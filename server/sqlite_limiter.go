@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// available is -1 once a bucket has been emptied within its tick,
+	// and buckets start again when the configured limits have changed
+	takeLimitSQL = `
+INSERT INTO rate_limits (limit_key, max_tokens, available, interval_ns, start_time, last_tick)
+VALUES (?1, ?2, ?2 - 1, ?3, ?4, 0)
+ON CONFLICT (limit_key) DO UPDATE SET
+    available = CASE WHEN max_tokens != ?2 OR interval_ns != ?3 THEN ?2 - 1
+        ELSE max(CASE WHEN (?4 - start_time) / interval_ns > last_tick THEN max_tokens ELSE available END - 1, -1) END,
+    last_tick = CASE WHEN max_tokens != ?2 OR interval_ns != ?3 THEN 0
+        ELSE max(last_tick, (?4 - start_time) / interval_ns) END,
+    start_time = CASE WHEN max_tokens != ?2 OR interval_ns != ?3 THEN ?4 ELSE start_time END,
+    max_tokens = ?2,
+    interval_ns = ?3
+RETURNING max_tokens, available, interval_ns, start_time, last_tick`
+	getLimitSQL = `SELECT max_tokens, available, interval_ns, start_time, last_tick FROM rate_limits WHERE limit_key = ?`
+	setLimitSQL = `
+INSERT OR REPLACE INTO rate_limits (limit_key, max_tokens, available, interval_ns, start_time, last_tick)
+VALUES (?, ?, ?, ?, ?, 0)`
+	burstLimitSQL = `
+INSERT INTO rate_limits (limit_key, max_tokens, available, interval_ns, start_time, last_tick)
+VALUES (?1, ?2, ?2 + ?5, ?3, ?4, 0)
+ON CONFLICT (limit_key) DO UPDATE SET available = max(available, 0) + ?5`
+	// buckets are full again after the tick in which they were last used
+	expireLimitsSQL = `DELETE FROM rate_limits WHERE start_time + (last_tick + 1) * interval_ns < ?`
+)
+
+// sqliteLimiterStore is a limiter.Store with the same token buckets as
+// memorystore, which are kept across restarts and can be shared by
+// all processes that use the same database file.
+type sqliteLimiterStore struct {
+	db       *sql.DB
+	tokens   uint64
+	interval time.Duration
+	now      func() time.Time
+	closed   atomic.Bool
+}
+
+func (c *config) newSqliteLimiterStore() (*sqliteLimiterStore, error) {
+	// the schema has been migrated by the secret store
+	db, err := c.openSqliteDB()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteLimiterStore{
+		db:       db,
+		tokens:   c.LimitCount,
+		interval: c.LimitPeriod,
+		now:      time.Now,
+	}, nil
+}
+
+func (s *sqliteLimiterStore) Take(ctx context.Context, key string) (tokens, remaining, reset uint64, ok bool, err error) {
+	if s.closed.Load() {
+		return 0, 0, 0, false, nil
+	}
+	now := s.now().UnixNano()
+	var available, interval, start, tick int64
+	err = s.db.QueryRowContext(ctx, takeLimitSQL, key, s.tokens, s.interval.Nanoseconds(), now).
+		Scan(&tokens, &available, &interval, &start, &tick)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	reset = uint64(start + (tick+1)*interval)
+	if available < 0 {
+		return tokens, 0, reset, false, nil
+	}
+	return tokens, uint64(available), reset, true, nil
+}
+
+func (s *sqliteLimiterStore) Get(ctx context.Context, key string) (tokens, remaining uint64, err error) {
+	if s.closed.Load() {
+		return 0, 0, nil
+	}
+	var available, interval, start, tick int64
+	err = s.db.QueryRowContext(ctx, getLimitSQL, key).Scan(&tokens, &available, &interval, &start, &tick)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if (s.now().UnixNano()-start)/interval > tick {
+		return tokens, tokens, nil
+	}
+	return tokens, uint64(max(available, 0)), nil
+}
+
+func (s *sqliteLimiterStore) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	if s.closed.Load() {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, setLimitSQL, key, tokens, tokens, interval.Nanoseconds(), s.now().UnixNano())
+	return err
+}
+
+func (s *sqliteLimiterStore) Burst(ctx context.Context, key string, tokens uint64) error {
+	if s.closed.Load() {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, burstLimitSQL, key, s.tokens, s.interval.Nanoseconds(), s.now().UnixNano(), tokens)
+	return err
+}
+
+func (s *sqliteLimiterStore) Close(context.Context) error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func testSqliteLimiterStore(t *testing.T, tokens uint64) (*sqliteLimiterStore, *time.Time) {
+	db, err := testDB()
+	assert.NilError(t, err)
+	now := time.Now()
+	store := &sqliteLimiterStore{
+		db:       db,
+		tokens:   tokens,
+		interval: time.Minute,
+		now:      func() time.Time { return now },
+	}
+	t.Cleanup(func() { store.Close(context.Background()) })
+	return store, &now
+}
+
+func TestSqliteLimiterTake(t *testing.T) {
+	ctx := context.Background()
+	store, now := testSqliteLimiterStore(t, 2)
+	start := *now
+
+	for _, want := range []uint64{1, 0} {
+		tokens, remaining, reset, ok, err := store.Take(ctx, "wibble")
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+		assert.Equal(t, uint64(2), tokens)
+		assert.Equal(t, want, remaining)
+		assert.Equal(t, uint64(start.Add(time.Minute).UnixNano()), reset)
+	}
+	for range 2 {
+		_, remaining, _, ok, err := store.Take(ctx, "wibble")
+		assert.NilError(t, err)
+		assert.Assert(t, !ok)
+		assert.Equal(t, uint64(0), remaining)
+	}
+
+	// other keys have their own buckets
+	_, _, _, ok, err := store.Take(ctx, "wobble")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+
+	*now = now.Add(90 * time.Second)
+	tokens, remaining, err := store.Get(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(2), tokens)
+	assert.Equal(t, uint64(2), remaining)
+
+	_, remaining, reset, ok, err := store.Take(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, uint64(1), remaining)
+	assert.Equal(t, uint64(start.Add(2*time.Minute).UnixNano()), reset)
+}
+
+func TestSqliteLimiterChangedLimits(t *testing.T) {
+	ctx := context.Background()
+	store, now := testSqliteLimiterStore(t, 2)
+
+	for range 3 {
+		_, _, _, _, err := store.Take(ctx, "wibble")
+		assert.NilError(t, err)
+	}
+
+	// buckets start again with new limits, rather than when they expire
+	*now = now.Add(10 * time.Second)
+	store.tokens = 5
+	store.interval = time.Hour
+	tokens, remaining, reset, ok, err := store.Take(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, uint64(5), tokens)
+	assert.Equal(t, uint64(4), remaining)
+	assert.Equal(t, uint64(now.Add(time.Hour).UnixNano()), reset)
+
+	*now = now.Add(2 * time.Minute)
+	_, remaining, reset, ok, err = store.Take(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, uint64(3), remaining)
+	assert.Equal(t, uint64(now.Add(58*time.Minute).UnixNano()), reset)
+}
+
+func TestSqliteLimiterSetAndBurst(t *testing.T) {
+	ctx := context.Background()
+	store, _ := testSqliteLimiterStore(t, 2)
+
+	tokens, remaining, err := store.Get(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(0), tokens)
+	assert.Equal(t, uint64(0), remaining)
+
+	assert.NilError(t, store.Set(ctx, "wibble", 5, time.Hour))
+	tokens, remaining, err = store.Get(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(5), tokens)
+	assert.Equal(t, uint64(5), remaining)
+
+	assert.NilError(t, store.Burst(ctx, "wibble", 3))
+	_, remaining, err = store.Get(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(8), remaining)
+
+	assert.NilError(t, store.Burst(ctx, "wobble", 3))
+	tokens, remaining, err = store.Get(ctx, "wobble")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(2), tokens)
+	assert.Equal(t, uint64(5), remaining)
+}
+
+func TestSqliteLimiterCleanup(t *testing.T) {
+	ctx := context.Background()
+	limits, now := testSqliteLimiterStore(t, 2)
+	store := sqliteStore{db: limits.db, now: func() time.Time { return *now }}
+
+	_, _, _, _, err := limits.Take(ctx, "wibble")
+	assert.NilError(t, err)
+
+	store.expireSecrets(ctx, *now)
+	tokens, _, err := limits.Get(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(2), tokens)
+
+	store.expireSecrets(ctx, now.Add(2*time.Minute))
+	tokens, _, err = limits.Get(ctx, "wibble")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(0), tokens)
+}
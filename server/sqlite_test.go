@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func testDB() (*sql.DB, error) {
+	dsn := "file:test.db?mode=memory"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err = migrateSchema(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func TestSqliteRoundTrip(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	ctx := context.Background()
+	store := sqliteStore{db: db, now: clock}
+	defer store.Close()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+	})
+	assert.NilError(t, err)
+
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSqliteGetSecret_Expired(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	ctx := context.Background()
+	store := sqliteStore{db: db, now: clock}
+	defer store.Close()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+	})
+	assert.NilError(t, err)
+
+	now = now.Add(2 * time.Hour)
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestSqliteGetSecret_Expired_Cleanup(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	ctx := context.Background()
+	store := sqliteStore{db: db, now: clock}
+	defer store.Close()
+
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+	})
+	assert.NilError(t, err)
+
+	store.expireSecrets(ctx, now.Add(2*time.Hour))
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSqliteStatusAndRevoke(t *testing.T) {
+	db, err := testDB()
+	assert.NilError(t, err)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	ctx := context.Background()
+	store := sqliteStore{db: db, now: clock}
+	defer store.Close()
+
+	retrievedToken := NewSecretKey()
+	key, err := store.Put(ctx, &SecretWithTTL{
+		Secret: "wibble",
+		TTL:    time.Hour,
+		Token:  retrievedToken,
+	})
+	assert.NilError(t, err)
+
+	status, err := store.Status(ctx, retrievedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusPending, status.State)
+
+	_, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+
+	status, err = store.Status(ctx, retrievedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusRetrieved, status.State)
+
+	revokedToken := NewSecretKey()
+	key, err = store.Put(ctx, &SecretWithTTL{
+		Secret: "wobble",
+		TTL:    time.Hour,
+		Token:  revokedToken,
+	})
+	assert.NilError(t, err)
+
+	status, err = store.Delete(ctx, revokedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusRevoked, status.State)
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	expiredToken := NewSecretKey()
+	_, err = store.Put(ctx, &SecretWithTTL{
+		Secret: "wubble",
+		TTL:    time.Hour,
+		Token:  expiredToken,
+	})
+	assert.NilError(t, err)
+
+	now = now.Add(2 * time.Hour)
+
+	status, err = store.Delete(ctx, expiredToken)
+	assert.NilError(t, err)
+	assert.Equal(t, StatusExpired, status.State)
+
+	_, err = store.Status(ctx, NewSecretKey())
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSqliteSecureDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goldfish.db")
+	c := testConfig()
+	c.SqliteFile = path
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opened, err := c.newSqliteStore(ctx, nil, nil)
+	assert.NilError(t, err)
+	store := opened.(*sqliteStore)
+	defer store.Close()
+
+	_, err = store.db.ExecContext(ctx, "PRAGMA journal_mode = WAL")
+	assert.NilError(t, err)
+
+	files := func() []byte {
+		var data []byte
+		for _, name := range []string{path, path + "-wal", path + "-journal"} {
+			content, err := os.ReadFile(name)
+			if !errors.Is(err, os.ErrNotExist) {
+				assert.NilError(t, err)
+			}
+			data = append(data, content...)
+		}
+		return data
+	}
+
+	ciphertext := strings.Repeat(NewSecretKey(), 8)
+	key, err := store.Put(ctx, &SecretWithTTL{Secret: ciphertext, TTL: time.Hour})
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Contains(files(), []byte(ciphertext)))
+
+	_, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+	store.compact(ctx)
+	assert.Assert(t, !bytes.Contains(files(), []byte(ciphertext)))
+
+	var mode int
+	assert.NilError(t, store.db.QueryRowContext(ctx, autoVacuumSQL).Scan(&mode))
+	assert.Equal(t, 2, mode)
+}
+
+func TestSqliteTakeOnce(t *testing.T) {
+	c := testConfig()
+	c.SqliteFile = filepath.Join(t.TempDir(), "goldfish.db")
+	store, err := c.newSqliteStore(t.Context(), nil, nil)
+	assert.NilError(t, err)
+	defer store.Close()
+	ctx := context.Background()
+
+	// concurrent requests read the secret from different connections
+	for range 100 {
+		key, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+		assert.NilError(t, err)
+		var taken atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for range 8 {
+			wg.Go(func() {
+				<-start
+				if _, err := store.Take(ctx, key); err == nil {
+					taken.Add(1)
+				}
+			})
+		}
+		close(start)
+		wg.Wait()
+		assert.Equal(t, int32(1), taken.Load())
+	}
+}
+
+func BenchmarkSqliteParallel(b *testing.B) {
+	for _, mode := range []string{"delete", "wal"} {
+		b.Run(mode, func(b *testing.B) {
+			c := testConfig()
+			c.SqliteFile = filepath.Join(b.TempDir(), "goldfish.db")
+			c.SqliteJournalMode = mode
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			store, err := c.newSqliteStore(ctx, nil, nil)
+			assert.NilError(b, err)
+			defer store.Close()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key, err := store.Put(ctx, &SecretWithTTL{Secret: "wibble", TTL: time.Hour})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err = store.Take(ctx, key); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/digitalocean-labs/goldfish/server"
+	"github.com/digitalocean-labs/goldfish/server/storetest"
+)
+
+func TestSqliteStoreConformance(t *testing.T) {
+	storetest.Run(t, server.OpenSqliteTestStore)
+}
+
+func TestRedisStoreConformance(t *testing.T) {
+	storetest.Run(t, server.OpenRedisTestStore)
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storetest.Run(t, server.OpenMemoryTestStore)
+}
+
+func TestEtcdStoreConformance(t *testing.T) {
+	storetest.Run(t, server.OpenEtcdTestStore)
+}
@@ -0,0 +1,284 @@
+// Package storetest checks that a server.Store behaves
+// in the way that goldfish expects of its backends.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/digitalocean-labs/goldfish/server"
+)
+
+// Opener returns a new and empty store, along with a function
+// that moves the clock of the store forward to expire secrets.
+type Opener func(t *testing.T) (store server.Store, advance func(time.Duration))
+
+var validKey = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// Run checks a store with subtests of t, opening a new store for each of them.
+func Run(t *testing.T, open Opener) {
+	tests := map[string]func(t *testing.T, store server.Store, advance func(time.Duration)){
+		"TakeOnce":        testTakeOnce,
+		"TakeConcurrent":  testTakeConcurrent,
+		"ChosenKey":       testChosenKey,
+		"UnknownKey":      testUnknownKey,
+		"Expired":         testExpired,
+		"StatusAndDelete": testStatusAndDelete,
+		"UnknownToken":    testUnknownToken,
+		"Stats":           testStats,
+		"Peek":            testPeek,
+		"NotBefore":       testNotBefore,
+		"AllowedCIDRs":    testAllowedCIDRs,
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			store, advance := open(t)
+			defer store.Close()
+			test(t, store, advance)
+		})
+	}
+}
+
+func put(t *testing.T, store server.Store, secret, token string) string {
+	key, err := store.Put(context.Background(), &server.SecretWithTTL{
+		Secret: secret,
+		TTL:    time.Hour,
+		Token:  token,
+	})
+	assert.NilError(t, err)
+	assert.Assert(t, validKey.MatchString(key), key)
+	return key
+}
+
+func testTakeOnce(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	key := put(t, store, "wibble", "")
+
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, server.ErrNotFound)
+}
+
+func testTakeConcurrent(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	for range 20 {
+		key := put(t, store, "wibble", "")
+		var taken atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for range 8 {
+			wg.Go(func() {
+				<-start
+				if _, err := store.Take(ctx, key); err == nil {
+					taken.Add(1)
+				}
+			})
+		}
+		close(start)
+		wg.Wait()
+		assert.Equal(t, int32(1), taken.Load())
+	}
+}
+
+// testChosenKey checks that a store keeps secrets under the key
+// that they are given, which encryption at rest depends on.
+func testChosenKey(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	chosen := server.NewSecretKey()
+	key, err := store.Put(ctx, &server.SecretWithTTL{Key: chosen, Secret: "wibble", TTL: time.Hour})
+	assert.NilError(t, err)
+	assert.Equal(t, chosen, key)
+
+	secret, err := store.Take(ctx, chosen)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
+
+func testUnknownKey(t *testing.T, store server.Store, _ func(time.Duration)) {
+	_, err := store.Take(context.Background(), server.NewSecretKey())
+	assert.ErrorIs(t, err, server.ErrNotFound)
+}
+
+func testExpired(t *testing.T, store server.Store, advance func(time.Duration)) {
+	ctx := context.Background()
+	token := server.NewSecretKey()
+	key := put(t, store, "wibble", token)
+
+	advance(2 * time.Hour)
+
+	// stores may no longer know about expired secrets
+	_, err := store.Peek(ctx, key)
+	assert.Assert(t, errors.Is(err, server.ErrExpired) || errors.Is(err, server.ErrNotFound), err)
+	_, err = store.Take(ctx, key)
+	assert.Assert(t, errors.Is(err, server.ErrExpired) || errors.Is(err, server.ErrNotFound), err)
+
+	status, err := store.Status(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusExpired, status.State)
+
+	status, err = store.Delete(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusExpired, status.State)
+}
+
+func testStatusAndDelete(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	retrievedToken := server.NewSecretKey()
+	key := put(t, store, "wibble", retrievedToken)
+
+	status, err := store.Status(ctx, retrievedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusPending, status.State)
+	assert.Assert(t, status.ExpireAt.After(time.Now()))
+
+	_, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+
+	status, err = store.Status(ctx, retrievedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusRetrieved, status.State)
+
+	// retrieved secrets cannot be deleted
+	status, err = store.Delete(ctx, retrievedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusRetrieved, status.State)
+
+	deletedToken := server.NewSecretKey()
+	key = put(t, store, "wobble", deletedToken)
+
+	status, err = store.Delete(ctx, deletedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusRevoked, status.State)
+
+	_, err = store.Take(ctx, key)
+	assert.ErrorIs(t, err, server.ErrNotFound)
+
+	status, err = store.Status(ctx, deletedToken)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusRevoked, status.State)
+}
+
+func testUnknownToken(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	_, err := store.Status(ctx, server.NewSecretKey())
+	assert.ErrorIs(t, err, server.ErrNotFound)
+
+	_, err = store.Delete(ctx, server.NewSecretKey())
+	assert.ErrorIs(t, err, server.ErrNotFound)
+}
+
+func testStats(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	stats, err := store.Stats(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, stats.Secrets)
+	assert.Assert(t, stats.OldestExpireAt.IsZero())
+
+	key := put(t, store, "wibble", "")
+	put(t, store, "wobble", server.NewSecretKey())
+
+	stats, err = store.Stats(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, stats.Secrets)
+	assert.Assert(t, stats.OldestExpireAt.After(time.Now()), stats.OldestExpireAt)
+	assert.Assert(t, !stats.NewestExpireAt.Before(stats.OldestExpireAt), stats.NewestExpireAt)
+
+	_, err = store.Take(ctx, key)
+	assert.NilError(t, err)
+
+	stats, err = store.Stats(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, stats.Secrets)
+}
+
+func testPeek(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	key := put(t, store, "wibble", "")
+
+	// peeking does not take the secret
+	for range 2 {
+		peek, err := store.Peek(ctx, key)
+		assert.NilError(t, err)
+		assert.Assert(t, peek.Exists)
+		assert.Assert(t, peek.ExpireAt.After(time.Now().Add(59*time.Minute)), peek.ExpireAt)
+		assert.Assert(t, peek.ExpireAt.Before(time.Now().Add(61*time.Minute)), peek.ExpireAt)
+		assert.Assert(t, peek.NotBefore.IsZero(), peek.NotBefore)
+	}
+
+	_, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+
+	_, err = store.Peek(ctx, key)
+	assert.ErrorIs(t, err, server.ErrNotFound)
+
+	_, err = store.Peek(ctx, server.NewSecretKey())
+	assert.ErrorIs(t, err, server.ErrNotFound)
+}
+
+func testNotBefore(t *testing.T, store server.Store, advance func(time.Duration)) {
+	ctx := context.Background()
+	token := server.NewSecretKey()
+	notBefore := time.Now().Add(30 * time.Minute).Truncate(time.Second)
+	key, err := store.Put(ctx, &server.SecretWithTTL{
+		Secret:    "wibble",
+		TTL:       time.Hour,
+		Token:     token,
+		NotBefore: notBefore,
+	})
+	assert.NilError(t, err)
+
+	// locked secrets are not taken
+	for range 2 {
+		_, err = store.Take(ctx, key)
+		var locked *server.LockedError
+		assert.Assert(t, errors.As(err, &locked), err)
+		assert.Assert(t, locked.NotBefore.Equal(notBefore), locked.NotBefore)
+		assert.ErrorIs(t, err, server.ErrLocked)
+	}
+
+	peek, err := store.Peek(ctx, key)
+	assert.NilError(t, err)
+	assert.Assert(t, peek.NotBefore.Equal(notBefore), peek.NotBefore)
+
+	status, err := store.Status(ctx, token)
+	assert.NilError(t, err)
+	assert.Equal(t, server.StatusPending, status.State)
+
+	advance(31 * time.Minute)
+
+	secret, err := store.Take(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", secret)
+}
+
+func testAllowedCIDRs(t *testing.T, store server.Store, _ func(time.Duration)) {
+	ctx := context.Background()
+	allowed := []netip.Prefix{netip.MustParsePrefix("10.8.0.0/16"), netip.MustParsePrefix("fd00:8::/32")}
+	key, err := store.Put(ctx, &server.SecretWithTTL{
+		Secret:       "wibble",
+		TTL:          time.Hour,
+		AllowedCIDRs: allowed,
+	})
+	assert.NilError(t, err)
+
+	peek, err := store.Peek(ctx, key)
+	assert.NilError(t, err)
+	assert.Assert(t, slices.Equal(allowed, peek.AllowedCIDRs), peek.AllowedCIDRs)
+
+	// secrets without allowed networks can be taken from anywhere
+	peek, err = store.Peek(ctx, put(t, store, "wobble", ""))
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(peek.AllowedCIDRs))
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultKeyID   = "vault"
+	vaultTimeout = 10 * time.Second
+)
+
+// vaultKeyProvider wraps data keys using the Vault Transit secrets
+// engine, so that the key-encryption key never leaves Vault. Vault
+// rotates the transit key by itself, so key IDs include the latest
+// version of it that has wrapped a data key, and values wrapped by
+// older versions are rekeyed once Vault has rotated it.
+type vaultKeyProvider struct {
+	addr   string
+	token  func() string
+	mount  string
+	key    string
+	client *http.Client
+
+	mu      sync.Mutex
+	version int
+}
+
+type vaultResponse struct {
+	Errors []string `json:"errors"`
+	Data   struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+}
+
+func (c *config) newVaultKeyProvider() (KeyProvider, error) {
+	if c.VaultAddr == "" {
+		return nil, errors.New("vault address is required")
+	}
+	if c.VaultToken == "" {
+		return nil, errors.New("vault token is required")
+	}
+	if _, err := url.Parse(c.VaultAddr); err != nil {
+		return nil, fmt.Errorf("bad vault address: %w", err)
+	}
+	log.Info("Encrypting secrets at rest", "provider", VaultKeyProvider, "addr", c.VaultAddr, "key", c.VaultTransitKey)
+	return &vaultKeyProvider{
+		addr:   strings.TrimSuffix(c.VaultAddr, "/"),
+		token:  func() string { return c.credential(&c.VaultToken) },
+		mount:  strings.Trim(c.VaultTransitMount, "/"),
+		key:    c.VaultTransitKey,
+		client: &http.Client{Timeout: vaultTimeout},
+	}, nil
+}
+
+// KeyID is only versioned once a data key has been wrapped,
+// which checkKeyProvider does before any secret is sealed.
+func (v *vaultKeyProvider) KeyID() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.version == 0 {
+		return vaultKeyID
+	}
+	return fmt.Sprintf("%s-v%d", vaultKeyID, v.version)
+}
+
+func (v *vaultKeyProvider) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}
+	res, err := v.transit(ctx, "encrypt", req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Data.Ciphertext == "" {
+		return nil, errors.New("vault returned no ciphertext")
+	}
+	if version, ok := vaultKeyVersion(res.Data.Ciphertext); ok {
+		v.mu.Lock()
+		v.version = max(v.version, version)
+		v.mu.Unlock()
+	}
+	return []byte(res.Data.Ciphertext), nil
+}
+
+// vaultKeyVersion reads the key version from
+// a "vault:v<version>:<data>" ciphertext.
+func vaultKeyVersion(ciphertext string) (int, bool) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	return version, err == nil
+}
+
+// UnwrapKey also opens values sealed before key IDs were versioned,
+// since Vault finds the version of a wrapped key from its ciphertext.
+func (v *vaultKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != vaultKeyID && !strings.HasPrefix(keyID, vaultKeyID+"-v") {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	req := map[string]string{"ciphertext": string(wrapped)}
+	res, err := v.transit(ctx, "decrypt", req)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Data.Plaintext)
+}
+
+func (v *vaultKeyProvider) transit(ctx context.Context, op string, body map[string]string) (*vaultResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	target := fmt.Sprintf("%s/v1/%s/%s/%s", v.addr, v.mount, op, url.PathEscape(v.key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.token())
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var parsed vaultResponse
+	if err = json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("vault %s failed with status %q: %w", op, res.Status, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault %s failed with status %q: %s", op, res.Status, strings.Join(parsed.Errors, "; "))
+	}
+	return &parsed, nil
+}
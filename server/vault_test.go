@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// vaultStub imitates the encrypt and decrypt endpoints of a Vault
+// transit key, without doing any actual encryption, and encrypts
+// with the version of the key that it returns.
+func vaultStub(t *testing.T, token string) (*httptest.Server, *atomic.Int64) {
+	version := new(atomic.Int64)
+	version.Store(1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/transit/{op}/goldfish", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data := make(map[string]string)
+		switch r.PathValue("op") {
+		case "encrypt":
+			data["ciphertext"] = fmt.Sprintf("vault:v%d:%s", version.Load(), req["plaintext"])
+		case "decrypt":
+			parts := strings.SplitN(req["ciphertext"], ":", 3)
+			data["plaintext"] = parts[len(parts)-1]
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, version
+}
+
+func testVaultProvider(addr, token string) *vaultKeyProvider {
+	return &vaultKeyProvider{
+		addr:   addr,
+		token:  func() string { return token },
+		mount:  "transit",
+		key:    "goldfish",
+		client: http.DefaultClient,
+	}
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	server, _ := vaultStub(t, "s.wibble")
+	keys := testVaultProvider(server.URL, "s.wibble")
+
+	ctx := context.Background()
+	keyHash := hashValue(NewSecretKey())
+	assert.NilError(t, checkKeyProvider(ctx, keys))
+
+	sealed, err := sealValue(ctx, keys, "wibble", keyHash)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(sealed, "gf2:vault-v1:"))
+
+	plain, err := openValue(ctx, keys, sealed, keyHash)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", plain)
+}
+
+func TestVaultKeyProvider_Rotation(t *testing.T) {
+	server, version := vaultStub(t, "s.wibble")
+	keys := testVaultProvider(server.URL, "s.wibble")
+
+	ctx := context.Background()
+	keyHash := hashValue(NewSecretKey())
+	assert.NilError(t, checkKeyProvider(ctx, keys))
+	sealed, err := sealValue(ctx, keys, "wibble", keyHash)
+	assert.NilError(t, err)
+	assert.Assert(t, !needsRekey(keys, sealed, keyHash))
+
+	// values from before key IDs were versioned can still be opened
+	unversioned := strings.Replace(sealed, "gf2:vault-v1:", "gf2:vault:", 1)
+	plain, err := openValue(ctx, keys, unversioned, keyHash)
+	assert.NilError(t, err)
+	assert.Equal(t, "wibble", plain)
+	assert.Assert(t, needsRekey(keys, unversioned, keyHash))
+
+	// rekey finds the values of older versions once vault rotates its key
+	version.Store(2)
+	assert.NilError(t, checkKeyProvider(ctx, keys))
+	assert.Equal(t, "vault-v2", keys.KeyID())
+	assert.Assert(t, needsRekey(keys, sealed, keyHash))
+
+	resealed, err := resealValue(ctx, keys, sealed, keyHash)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(resealed, "gf2:vault-v2:"))
+	assert.Assert(t, !needsRekey(keys, resealed, keyHash))
+}
+
+func TestVaultKeyProvider_FailClosed(t *testing.T) {
+	server, _ := vaultStub(t, "s.wibble")
+	ctx := context.Background()
+
+	keys := testVaultProvider(server.URL, "s.wobble")
+	err := checkKeyProvider(ctx, keys)
+	assert.ErrorContains(t, err, "permission denied")
+
+	server.Close()
+	keys = testVaultProvider(server.URL, "s.wibble")
+	err = checkKeyProvider(ctx, keys)
+	assert.ErrorContains(t, err, "key provider check failed")
+}